@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the achieved arrival rate is logged.
+	arrivalsReportInterval = 10 * time.Second
+)
+
+// arrivals schedules connection attempts at a target rate, either evenly
+// spaced (fixed) or exponentially distributed (poisson), and keeps track of
+// how far behind schedule the attempts were actually started.
+type arrivals struct {
+	sync.Mutex
+
+	rate    float64
+	poisson bool
+
+	// Draws poisson intervals, only used by the dispatcher.
+	rand *rand.Rand
+
+	// Scheduled time of the next arrival, zero when idle.
+	next time.Time
+
+	// Accumulated statistics.
+	count    int64
+	busy     time.Duration
+	lagTotal time.Duration
+	lagMax   time.Duration
+
+	// Start of the current busy period.
+	busySince time.Time
+}
+
+// arrivalStats is a snapshot of the arrivals statistics.
+type arrivalStats struct {
+	Count        int64         `json:"count"`
+	TargetRate   float64       `json:"target_rate"`
+	AchievedRate float64       `json:"achieved_rate"`
+	MeanLag      time.Duration `json:"mean_lag"`
+	MaxLag       time.Duration `json:"max_lag"`
+}
+
+// newArrivals creates an arrival schedule for the given rate (per second) and
+// process, which must be either "fixed" or "poisson", drawing from a source
+// seeded with seed.
+func newArrivals(rate float64, process string, seed int64) (*arrivals, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid rate %v: must be positive", rate)
+	}
+
+	a := &arrivals{rate: rate, rand: rand.New(rand.NewSource(seed))}
+	switch process {
+	case "fixed":
+	case "poisson":
+		a.poisson = true
+	default:
+		return nil, fmt.Errorf("invalid arrival process %q: expected fixed or poisson", process)
+	}
+
+	return a, nil
+}
+
+// interval returns the time to wait between two consecutive arrivals.
+func (a *arrivals) interval() time.Duration {
+	if a.poisson {
+		return time.Duration(a.rand.ExpFloat64() / a.rate * float64(time.Second))
+	}
+	return time.Duration(float64(time.Second) / a.rate)
+}
+
+// wait blocks until the next arrival is due and returns its scheduled time.
+// The schedule is absolute, so arrivals started late are caught up with
+// afterwards. It returns false if quitting is closed in the meantime.
+func (a *arrivals) wait(quitting chan struct{}) (time.Time, bool) {
+	a.Lock()
+	now := time.Now()
+	if a.next.IsZero() {
+		a.next = now
+		a.busySince = now
+	}
+	scheduled := a.next
+	a.next = a.next.Add(a.interval())
+	a.Unlock()
+
+	if d := scheduled.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-quitting:
+			return scheduled, false
+		case <-timer.C:
+		}
+	}
+
+	return scheduled, true
+}
+
+// started records an arrival scheduled at the given time that has just been
+// handed over to a worker.
+func (a *arrivals) started(scheduled time.Time) {
+	lag := time.Since(scheduled)
+	if lag < 0 {
+		lag = 0
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.count++
+	a.lagTotal += lag
+	if lag > a.lagMax {
+		a.lagMax = lag
+	}
+}
+
+// idle resets the schedule once there is nothing left to dial, so idle time
+// is not caught up with on the next burst.
+func (a *arrivals) idle() {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.next.IsZero() {
+		a.busy += a.elapsed()
+		a.next = time.Time{}
+	}
+}
+
+// elapsed returns the length of the current busy period, which lasts at least
+// until the next arrival would have been scheduled.
+func (a *arrivals) elapsed() time.Duration {
+	elapsed := time.Since(a.busySince)
+	if scheduled := a.next.Sub(a.busySince); scheduled > elapsed {
+		elapsed = scheduled
+	}
+	return elapsed
+}
+
+// stats returns a snapshot of the arrivals statistics.
+func (a *arrivals) stats() arrivalStats {
+	a.Lock()
+	defer a.Unlock()
+
+	busy := a.busy
+	if !a.next.IsZero() {
+		busy += a.elapsed()
+	}
+
+	s := arrivalStats{
+		Count:      a.count,
+		TargetRate: a.rate,
+		MaxLag:     a.lagMax,
+	}
+	if busy > 0 {
+		s.AchievedRate = float64(a.count) / busy.Seconds()
+	}
+	if a.count > 0 {
+		s.MeanLag = a.lagTotal / time.Duration(a.count)
+	}
+
+	return s
+}
+
+// report periodically logs the achieved arrival rate until quitting is closed.
+func (a *arrivals) report(quitting chan struct{}) {
+	ticker := time.NewTicker(arrivalsReportInterval)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-quitting:
+			return
+		case <-ticker.C:
+		}
+
+		s := a.stats()
+		if s.Count == last {
+			continue
+		}
+		last = s.Count
+
+		log.Printf(
+			"Arrivals: %d started, %.2f/s achieved (target %.2f/s), lag mean=%v max=%v\n",
+			s.Count, s.AchievedRate, s.TargetRate, s.MeanLag, s.MaxLag,
+		)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errMessageLimit = errors.New("message limit reached")
+)
+
+// connection is an established benchmarker websocket connection.
+type connection struct {
+	index    int
+	data     templateData
+	endpoint string
+	ws       *util.WebSocketClient
+
+	// Random source of the connection, and the workload payload bound to it.
+	rand    *rand.Rand
+	payload *compiledTemplate
+
+	// Measures round trip times, nil when latency is not measured.
+	tracker *latencyTracker
+
+	// Closed when the connection is asked to terminate gracefully.
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Close asks the connection to terminate gracefully by sending a close frame
+func (c *connection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+}
+
+// goAway sends a close message for graceful termination.
+func (c *connection) goAway() {
+	c.ws.SendMessage(&util.Message{
+		Type: websocket.CloseMessage,
+		Data: websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+	})
+}
+
+// send renders and sends the next workload message of a connection. When
+// measuring latency the message stamp is handed to the payload as {{.stamp}},
+// payloads not carrying it get it prepended. Messages are only tracked for a
+// reply once sent.
+func (p *pool) send(c *connection) error {
+	c.data.nextMessage()
+
+	var seq uint64
+	var stamped time.Time
+	var stamp []byte
+	if c.tracker != nil {
+		seq, stamped, stamp = c.tracker.stamp()
+		c.data["stamp"] = string(stamp)
+	}
+
+	data, err := c.payload.render(c.data)
+	if err != nil {
+		return err
+	}
+
+	if stamp != nil && !bytes.Contains(data, stamp) {
+		data = append(stamp, data...)
+	}
+
+	if err := p.sendMessage(c, data); err != nil {
+		return err
+	}
+
+	if c.tracker != nil {
+		c.tracker.track(seq, stamped)
+	}
+	return nil
+}
+
+// sendMessage sends a workload or script message of a connection, charging
+// it to the message limit. Messages larger than the read limit are not sent,
+// neither are any once the limit is reached.
+func (p *pool) sendMessage(c *connection, data []byte) error {
+	if len(data) > int(p.readLimit) {
+		return fmt.Errorf("message of %d bytes to %s exceeds the read limit of %d, not sent", len(data), c.endpoint, p.readLimit)
+	}
+
+	if !p.reserve() {
+		return errMessageLimit
+	}
+	if err := c.sendMessage(p.messageType, data); err != nil {
+		p.unreserve()
+		return err
+	}
+	p.commit()
+	return nil
+}
+
+// sendMessage enqueues a message for sending.
+func (c *connection) sendMessage(mt int, data []byte) error {
+	err := c.ws.SendMessage(&util.Message{
+		Type: mt,
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+
+	wsMessagesSent.Inc()
+	wsBytesSent.Add(float64(len(data)))
+	return nil
+}
+
+// connect tries to establish and handle a connection, accounting and
+// logging failures.
+func (p *pool) connect(index int, r *rand.Rand) error {
+	err := p.connectAndHandle(index, r)
+	if err != nil {
+		wsConnectionsFailed.WithLabelValues(errorClass(err)).Inc()
+		log.Printf("%v\n", err)
+	}
+	return err
+}
+
+// connectRetrying establishes a new connection, retrying failed attempts up
+// to the pool retry limit unless the feeder ran out of rows. Retries keep the
+// connection accounted as dialing, but paced ones only hold an in flight slot
+// while actually dialing: the first attempt holds the one acquired by the
+// dispatcher.
+func (p *pool) connectRetrying(index int) {
+	r := p.connectionRand(index)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if !p.acquire() {
+				return
+			}
+			wsConnectRetries.Inc()
+		}
+
+		err := p.connect(index, r)
+		p.release()
+		if err == nil {
+			if attempt > 0 {
+				wsConnectionsEstablishedOnRetry.Inc()
+			}
+			return
+		}
+
+		// rows do not come back, retrying a missing one is pointless
+		if _, exhausted := err.(*feederExhaustedError); exhausted || attempt >= p.retries {
+			return
+		}
+
+		timer := time.NewTimer(p.retryDelay)
+		select {
+		case <-p.quitting:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// connectAndHandle establishes a connection drawing random values from r
+// and handles it in the background.
+func (p *pool) connectAndHandle(index int, r *rand.Rand) error {
+	wsConnectionsAttempted.Inc()
+
+	data, err := p.templateData(index, r)
+	if err != nil {
+		return err
+	}
+
+	endpointRaw, err := p.targets[index%len(p.targets)].bind(r).render(data)
+	if err != nil {
+		return err
+	}
+	endpoint := string(endpointRaw)
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+
+	headers, err := p.headers.bind(r).render(data)
+	if err != nil {
+		return err
+	}
+
+	var origin string
+	if p.origin != nil {
+		originRaw, err := p.origin.bind(r).render(data)
+		if err != nil {
+			return err
+		}
+		origin = string(originRaw)
+	} else {
+		originURL := *endpointURL
+		if endpointURL.Scheme == "wss" {
+			originURL.Scheme = "https"
+		} else {
+			originURL.Scheme = "http"
+		}
+		origin = originURL.String()
+	}
+
+	if headers.Get("Origin") == "" {
+		headers.Set("Origin", origin)
+	}
+
+	log.Printf("Trying to connect to: %s\n", endpoint)
+
+	start := time.Now()
+	conn, trace, err := p.dialer.dial(endpoint, headers)
+	if err != nil {
+		return err
+	}
+
+	p.dials.Record(time.Since(start))
+	wsDialDuration.Observe(time.Since(start).Seconds())
+	if trace.dns > 0 {
+		p.dnsLookups.Record(trace.dns)
+		wsDNSDuration.Observe(trace.dns.Seconds())
+	}
+	p.tcpConnects.Record(trace.tcp)
+	wsTCPConnectDuration.Observe(trace.tcp.Seconds())
+	if trace.proxy > 0 {
+		p.proxyConnects.Record(trace.proxy)
+		wsProxyConnectDuration.Observe(trace.proxy.Seconds())
+	}
+	if trace.tls > 0 {
+		p.tlsHandshakes.Record(trace.tls)
+		wsTLSHandshakeDuration.Observe(trace.tls.Seconds())
+		wsTLSHandshakes.Inc()
+		if trace.resumed {
+			wsTLSResumed.Inc()
+		}
+	}
+	p.upgrades.Record(trace.upgrade)
+	wsUpgradeDuration.Observe(trace.upgrade.Seconds())
+	wsConnectionsEstablished.Inc()
+
+	ws := util.NewWebSocketClient(conn)
+	ws.SetReadLimit(p.readLimit)
+	ws.Run()
+
+	log.Printf("Connected to: %s\n", endpoint)
+
+	c := &connection{
+		index:    index,
+		data:     data,
+		endpoint: endpoint,
+		ws:       ws,
+		rand:     r,
+		closing:  make(chan struct{}),
+	}
+	if p.workload != nil {
+		c.payload = p.workload.payload.bind(r)
+	}
+	if p.latency != nil {
+		c.tracker = newLatencyTracker(p.latency)
+	}
+	p.register(c)
+
+	wsConnectionsActive.Inc()
+
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+
+		if p.handle(c) || p.reconnect == nil {
+			return
+		}
+
+		p.reconnectLoop(index, r, time.Now())
+	}()
+
+	return nil
+}
+
+// handle processes a connection until it is closed, it returns true if the
+// benchmarker asked for the connection to be closed.
+func (p *pool) handle(c *connection) bool {
+	defer p.unregister(c)
+	defer log.Printf("Disconnected from: %s\n", c.endpoint)
+	defer func() {
+		wsConnectionsActive.Dec()
+		wsConnectionsClosed.Inc()
+	}()
+
+	if c.tracker != nil {
+		defer c.tracker.close()
+	}
+
+	var timer *time.Timer
+	var sending <-chan time.Time
+	var rescheduled <-chan struct{}
+	startSending := func() {
+		if p.workload != nil {
+			rescheduled = p.workload.changes()
+			timer = time.NewTimer(p.workload.first(c.rand))
+			sending = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	// run the connection script before sending the workload
+	var script *scriptRun
+	if len(p.script) > 0 {
+		script = newScriptRun(p.script, c.rand)
+		defer script.stop()
+	}
+
+	goingAway := false
+	quitting, closing := p.quitting, c.closing
+	goAway := func() {
+		c.goAway()
+		goingAway = true
+		script = nil
+		quitting, closing, sending, rescheduled = nil, nil, nil, nil
+	}
+
+	// scripted handles the outcome of a script step, sending the workload
+	// once every step succeeded
+	scripted := func(err error) {
+		if err != nil {
+			p.scriptFailed(c, err)
+			goAway()
+			return
+		}
+		if script.done() {
+			wsScriptsCompleted.Inc()
+			script = nil
+			startSending()
+		}
+	}
+
+	if script != nil {
+		scripted(script.advance(p, c))
+	} else {
+		startSending()
+	}
+
+	for {
+		var scripting <-chan time.Time
+		if script != nil {
+			scripting = script.C()
+		}
+
+		select {
+		case m, ok := <-c.ws.ReadMessage():
+			if !ok {
+				if err := c.ws.Err(); err != nil && !goingAway {
+					p.dropped(c, err)
+				}
+				return goingAway
+			}
+			wsMessagesReceived.Inc()
+			wsBytesReceived.Add(float64(len(m.Data)))
+			if c.tracker != nil {
+				c.tracker.match(m.Data)
+			}
+			if script != nil {
+				scripted(script.received(p, c, m.Data))
+			}
+		case <-scripting:
+			scripted(script.fired(p, c))
+		case <-sending:
+			timer.Reset(p.workload.next(c.rand))
+			if _, paused := p.workload.state(); paused {
+				continue
+			}
+			if err := p.send(c); err != nil && err != errMessageLimit {
+				log.Printf("%v\n", err)
+			}
+		case <-rescheduled:
+			// start over with the new schedule instead of waiting for
+			// a delay drawn from the old one
+			rescheduled = p.workload.changes()
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(p.workload.first(c.rand))
+		case <-quitting:
+			goAway()
+		case <-closing:
+			goAway()
+		}
+	}
+}
+
+// dropped accounts and logs a connection dropped by an error.
+func (p *pool) dropped(c *connection, err error) {
+	wsConnectionsDropped.WithLabelValues(errorClass(err)).Inc()
+	log.Printf("Connection to %s dropped: %v\n", c.endpoint, err)
+}
+
+// scriptFailed accounts and logs a connection script failure.
+func (p *pool) scriptFailed(c *connection, err error) {
+	wsScriptsFailed.Inc()
+	log.Printf("Script failed on %s: %v\n", c.endpoint, err)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	errNoWorkload = errors.New("no send schedule configured for this run")
+)
+
+// controller exposes a JSON API to steer a running benchmarker.
+type controller struct {
+	pool  *pool
+	cfg   runConfig
+	start time.Time
+}
+
+// connectionsRequest adds, removes or sets the number of connections.
+type connectionsRequest struct {
+	Add    int  `json:"add"`
+	Remove int  `json:"remove"`
+	Target *int `json:"target"`
+}
+
+// sendingRequest pauses, resumes or reschedules message sending.
+type sendingRequest struct {
+	Paused   *bool  `json:"paused"`
+	Schedule string `json:"schedule"`
+}
+
+// sendingStatus is the current state of message sending.
+type sendingStatus struct {
+	Schedule string `json:"schedule"`
+	Paused   bool   `json:"paused"`
+}
+
+// controlStatus is returned by every control endpoint.
+type controlStatus struct {
+	Connections poolStatus     `json:"connections"`
+	Sending     *sendingStatus `json:"sending,omitempty"`
+	Stats       *report        `json:"stats"`
+}
+
+// register installs the control endpoints in the given mux:
+//
+//	GET  /status       current status and stats
+//	POST /connections  one of {"add": N}, {"remove": N} or {"target": N}
+//	POST /sending      {"paused": true|false} and/or {"schedule": "rate:10"}
+func (c *controller) register(mux *http.ServeMux) {
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/connections", c.handleConnections)
+	mux.HandleFunc("/sending", c.handleSending)
+}
+
+func (c *controller) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	c.writeStatus(w)
+}
+
+func (c *controller) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req connectionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Add < 0 || req.Remove < 0 || (req.Target != nil && *req.Target < 0) {
+		writeError(w, http.StatusBadRequest, errors.New("connection counts must not be negative"))
+		return
+	}
+	if req.Target != nil && (req.Add > 0 || req.Remove > 0) || req.Add > 0 && req.Remove > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("only one of add, remove or target may be set"))
+		return
+	}
+
+	if req.Target != nil {
+		c.pool.scale(*req.Target)
+	}
+	c.pool.add(req.Add)
+	if req.Remove > 0 {
+		c.pool.remove(req.Remove)
+	}
+
+	c.writeStatus(w)
+}
+
+func (c *controller) handleSending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	if c.pool.workload == nil {
+		writeError(w, http.StatusConflict, errNoWorkload)
+		return
+	}
+
+	var req sendingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Schedule != "" {
+		if err := c.pool.workload.setSchedule(req.Schedule); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if req.Paused != nil {
+		c.pool.workload.setPaused(*req.Paused)
+	}
+
+	c.writeStatus(w)
+}
+
+func (c *controller) writeStatus(w http.ResponseWriter) {
+	stats, err := newReport(c.cfg, c.pool, c.start, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := controlStatus{
+		Connections: c.pool.status(),
+		Stats:       stats,
+	}
+	if c.pool.workload != nil {
+		schedule, paused := c.pool.workload.state()
+		status.Sending = &sendingStatus{schedule, paused}
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialer establishes websocket connections doing the TLS handshake itself, so
+// it can be timed apart from the upgrade and resumed from a session cache.
+type dialer struct {
+	tlsConfig *tls.Config
+
+	// Proxy all connections are tunnelled through, nil uses the environment.
+	proxy *url.URL
+
+	// Time allowed to resolve and connect (to the proxy when proxied, opening
+	// the tunnel included), for the TLS handshake and for the upgrade request,
+	// 0 waits forever.
+	connectTimeout time.Duration
+	tlsTimeout     time.Duration
+	upgradeTimeout time.Duration
+
+	// Local addresses connections are bound to round robin, none lets the
+	// system choose.
+	localAddrs    []net.IP
+	nextLocalAddr uint64
+
+	// Subprotocols requested in order of preference, the server must select
+	// one of them when set.
+	subprotocols []string
+}
+
+// subprotocolError is returned when the server does not select one of
+// the requested subprotocols.
+type subprotocolError struct {
+	selected string
+}
+
+func (e *subprotocolError) Error() string {
+	if e.selected == "" {
+		return "subprotocol mismatch: server selected none"
+	}
+	return fmt.Sprintf("subprotocol mismatch: server selected %q", e.selected)
+}
+
+// newDialer creates a dialer using tlsConfig for wss:// targets, nil uses the
+// default settings.
+func newDialer(tlsConfig *tls.Config) *dialer {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &dialer{tlsConfig: tlsConfig}
+}
+
+// dialTrace records the phases of a dial. When proxied, DNS and TCP times
+// are the ones of the proxy.
+type dialTrace struct {
+	// DNS resolution time, 0 for IP addresses.
+	dns time.Duration
+
+	// TCP connect time.
+	tcp time.Duration
+
+	// Time to open a tunnel through the proxy, 0 when not proxied.
+	proxy time.Duration
+
+	// TLS handshake time, 0 for ws:// targets.
+	tls     time.Duration
+	resumed bool
+
+	// Time from the connection being ready until the upgrade completes.
+	upgrade time.Duration
+}
+
+// dial connects to a websocket endpoint.
+func (d *dialer) dial(endpoint string, headers http.Header) (*websocket.Conn, *dialTrace, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proxyURL, err := d.proxyFor(u)
+	if err != nil {
+		return nil, nil, &proxyError{err}
+	}
+
+	trace := &dialTrace{}
+	wd := &websocket.Dialer{Subprotocols: d.subprotocols}
+
+	// Proxies and TLS are handled in NetDial, so wss:// targets are dialed as
+	// ws:// keeping the original Host header.
+	var tlsConfig *tls.Config
+	if u.Scheme == "wss" {
+		tlsConfig = d.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+
+		if headers.Get("Host") == "" {
+			headers.Set("Host", u.Host)
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		plain := *u
+		plain.Scheme = "ws"
+		plain.Host = net.JoinHostPort(u.Hostname(), port)
+		endpoint = plain.String()
+	}
+
+	var ready time.Time
+	wd.NetDial = func(network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		connectDeadline := deadline(d.connectTimeout)
+		if proxyURL != nil {
+			conn, err = d.dialTCP(trace, "tcp", proxyAddr(proxyURL), connectDeadline)
+			if _, ok := err.(*portsExhaustedError); ok {
+				return nil, err
+			}
+			if err != nil {
+				return nil, &proxyError{err}
+			}
+
+			start := time.Now()
+			conn.SetDeadline(connectDeadline)
+			if err := openTunnel(conn, proxyURL, addr); err != nil {
+				conn.Close()
+				if isTimeout(err) {
+					err = &timeoutError{"proxy", err}
+				}
+				return nil, &proxyError{err}
+			}
+			conn.SetDeadline(time.Time{})
+			trace.proxy = time.Since(start)
+		} else {
+			conn, err = d.dialTCP(trace, network, addr, connectDeadline)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if tlsConfig != nil {
+			start := time.Now()
+			tlsConn := tls.Client(conn, tlsConfig)
+			tlsConn.SetDeadline(deadline(d.tlsTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				if isTimeout(err) {
+					return nil, &timeoutError{"tls", err}
+				}
+				return nil, &tlsError{err}
+			}
+			tlsConn.SetDeadline(time.Time{})
+			trace.tls = time.Since(start)
+			trace.resumed = tlsConn.ConnectionState().DidResume
+			conn = tlsConn
+		}
+
+		ready = time.Now()
+		return &upgradeConn{Conn: conn, timeout: d.upgradeTimeout}, nil
+	}
+
+	conn, resp, err := wd.Dial(endpoint, headers)
+	if _, ok := err.(*timeoutError); !ok && isTimeout(err) {
+		return nil, nil, &timeoutError{"upgrade", err}
+	}
+	if err == websocket.ErrBadHandshake && resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, nil, &statusError{resp.StatusCode, resp.Status}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	trace.upgrade = time.Since(ready)
+
+	if len(d.subprotocols) > 0 && !contains(d.subprotocols, conn.Subprotocol()) {
+		conn.Close()
+		return nil, nil, &subprotocolError{conn.Subprotocol()}
+	}
+
+	return conn, trace, nil
+}
+
+// dialTCP resolves addr and opens a TCP connection to it from the next
+// local address, recording the time spent in each phase.
+func (d *dialer) dialTCP(trace *dialTrace, network, addr string, deadline time.Time) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var local net.IP
+	nd := &net.Dialer{Deadline: deadline}
+	if len(d.localAddrs) > 0 {
+		i := atomic.AddUint64(&d.nextLocalAddr, 1) - 1
+		local = d.localAddrs[i%uint64(len(d.localAddrs))]
+		nd.LocalAddr = &net.TCPAddr{IP: local}
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx := context.Background()
+		if !deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if isTimeout(err) {
+			return nil, &timeoutError{"connect", err}
+		}
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		trace.dns = time.Since(start)
+
+		ips = sameFamily(addrs, local)
+	}
+
+	start := time.Now()
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = nd.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			break
+		}
+	}
+	// binding a local address to port 0 fails with EADDRINUSE instead once
+	// its ports run out
+	if errors.Is(err, syscall.EADDRNOTAVAIL) || local != nil && errors.Is(err, syscall.EADDRINUSE) {
+		return nil, &portsExhaustedError{local, err}
+	}
+	if isTimeout(err) {
+		return nil, &timeoutError{"connect", err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	trace.tcp = time.Since(start)
+
+	return conn, nil
+}
+
+// sameFamily returns the resolved addresses, the ones of the same family as
+// the local address first.
+func sameFamily(addrs []net.IPAddr, local net.IP) []net.IP {
+	var same, other []net.IP
+	for _, addr := range addrs {
+		if local == nil || (addr.IP.To4() == nil) == (local.To4() == nil) {
+			same = append(same, addr.IP)
+		} else {
+			other = append(other, addr.IP)
+		}
+	}
+	return append(same, other...)
+}
+
+// proxyFor returns the proxy to reach a target through, the configured one
+// or else the one from the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY).
+func (d *dialer) proxyFor(u *url.URL) (*url.URL, error) {
+	if d.proxy != nil {
+		return d.proxy, nil
+	}
+
+	target := *u
+	target.Scheme = "http"
+	if u.Scheme == "wss" {
+		target.Scheme = "https"
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &target})
+}
+
+// upgradeConn applies the upgrade timeout in place of the handshake deadline
+// the websocket dialer sets first, clearing it once upgraded.
+type upgradeConn struct {
+	net.Conn
+	timeout time.Duration
+	started bool
+}
+
+func (c *upgradeConn) SetDeadline(t time.Time) error {
+	if !c.started {
+		c.started = true
+		t = deadline(c.timeout)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// deadline returns the deadline for a timeout starting now, zero for none.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"text/template"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+	"github.com/gorilla/websocket"
+)
+
+// tlsError is a failed TLS handshake.
+type tlsError struct {
+	err error
+}
+
+func (e *tlsError) Error() string {
+	return fmt.Sprintf("tls: %v", e.err)
+}
+
+// timeoutError is a dial phase (connect, proxy, tls or upgrade) timing out.
+type timeoutError struct {
+	phase string
+	err   error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout: %v", e.phase, e.err)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// isTimeout reports whether err is a timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// statusError is an upgrade request answered with an HTTP status other than
+// 101 Switching Protocols.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v: %s", websocket.ErrBadHandshake, e.status)
+}
+
+// errorClass returns a short label describing why a connection attempt
+// failed or an established connection was dropped:
+//
+//	dns                 the target host name could not be resolved
+//	connection_refused  nothing listening on the target address
+//	connection_reset    the connection was reset by the peer
+//	connect_timeout     resolving or connecting timed out
+//	proxy_timeout       connecting to the proxy or opening the tunnel timed out
+//	tls_timeout         the TLS handshake timed out
+//	upgrade_timeout     the upgrade response did not arrive in time
+//	timeout             anything else timing out
+//	ports_exhausted     no ephemeral ports left on the local address
+//	proxy               the proxy could not be reached or refused the tunnel
+//	tls                 the TLS handshake failed
+//	http_<code>         the upgrade request was answered with that status
+//	bad_handshake       the upgrade response was not a valid websocket one
+//	subprotocol         the server did not select a requested subprotocol
+//	dial                other network errors while connecting
+//	template            a URL or header template failed to render
+//	feeder_exhausted    a unique feeder had no row left for the connection
+//	read, write         reading or writing an established connection failed
+//	read_timeout, ...   as above, timing out (e.g. no pong received)
+//	close_<code>        the peer closed with an abnormal close code
+//	other               anything else
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case *util.ConnError:
+		return e.Class()
+	case *timeoutError:
+		return e.phase + "_timeout"
+	case *portsExhaustedError:
+		return "ports_exhausted"
+	case *proxyError:
+		if _, ok := e.err.(*timeoutError); ok {
+			return "proxy_timeout"
+		}
+		return "proxy"
+	case *tlsError:
+		return "tls"
+	case *statusError:
+		return fmt.Sprintf("http_%d", e.code)
+	case *subprotocolError:
+		return "subprotocol"
+	case *feederExhaustedError:
+		return "feeder_exhausted"
+	}
+
+	var execErr template.ExecError
+	if errors.As(err, &execErr) {
+		return "template"
+	}
+
+	if err == websocket.ErrBadHandshake {
+		return "bad_handshake"
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "connection_refused"
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) {
+		return "connection_reset"
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+
+	if _, ok := err.(*net.OpError); ok {
+		return "dial"
+	}
+
+	return "other"
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// templateData is the data URL, header and payload templates are rendered
+// with: the connection index under "index", the sequence number of the
+// message being sent by the connection under "seq" (starting at 1), its
+// latency stamp under "stamp" (empty unless measuring latency) plus the fields
+// of the feeder row assigned to the connection. It prints as the index so
+// {{.}} keeps working.
+type templateData map[string]interface{}
+
+func (d templateData) String() string {
+	return fmt.Sprint(d["index"])
+}
+
+// nextMessage advances the message sequence number.
+func (d templateData) nextMessage() {
+	d["seq"] = d["seq"].(int64) + 1
+}
+
+// reservedFields are the template data fields feeder rows may not set.
+var reservedFields = []string{"index", "seq", "stamp"}
+
+// feederExhaustedError is returned when a unique feeder has no row left for
+// a connection, retrying does not help.
+type feederExhaustedError struct {
+	index int
+	rows  int
+}
+
+func (e *feederExhaustedError) Error() string {
+	return fmt.Sprintf("feeder exhausted: no row left for connection %d (%d rows)", e.index, e.rows)
+}
+
+// feeder hands rows of a data file to connections.
+type feeder struct {
+	mode string
+	rows []map[string]interface{}
+}
+
+// loadFeeder reads the rows of a CSV (with a header line naming the fields)
+// or JSON Lines file, picked by its extension, to be handed to connections
+// following the given mode:
+//
+//	round-robin  connection N gets row N, wrapping around
+//	random       every connection gets a random row
+//	unique       connection N gets row N, failing once rows run out
+func loadFeeder(path, mode string) (*feeder, error) {
+	switch mode {
+	case "round-robin", "random", "unique":
+	default:
+		return nil, fmt.Errorf("invalid feeder mode %q: expected round-robin, random or unique", mode)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rows, err = readCSVRows(f)
+	case ".jsonl", ".ndjson":
+		rows, err = readJSONLRows(f)
+	default:
+		return nil, fmt.Errorf("invalid feeder %s: expected a .csv, .jsonl or .ndjson file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid feeder %s: %v", path, err)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("invalid feeder %s: no rows", path)
+	}
+
+	for i, row := range rows {
+		for _, field := range reservedFields {
+			if _, ok := row[field]; ok {
+				return nil, fmt.Errorf("invalid feeder %s: row %d: field %q is reserved", path, i+1, field)
+			}
+		}
+	}
+
+	return &feeder{mode: mode, rows: rows}, nil
+}
+
+func readCSVRows(r io.Reader) ([]map[string]interface{}, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	fields := records[0]
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(fields))
+		for i, field := range fields {
+			row[field] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONLRows(r io.Reader) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := make(map[string]interface{})
+		d := json.NewDecoder(strings.NewReader(text))
+		d.UseNumber()
+		if err := d.Decode(&row); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// row returns the row assigned to a connection, random rows are drawn from r.
+func (f *feeder) row(index int, r *rand.Rand) (map[string]interface{}, error) {
+	switch f.mode {
+	case "random":
+		return f.rows[r.Intn(len(f.rows))], nil
+	case "unique":
+		if index >= len(f.rows) {
+			return nil, &feederExhaustedError{index, len(f.rows)}
+		}
+		return f.rows[index], nil
+	}
+
+	return f.rows[index%len(f.rows)], nil
+}
+
+// templateData returns the template data of a connection.
+func (p *pool) templateData(index int, r *rand.Rand) (templateData, error) {
+	data := templateData{}
+	if p.feeder != nil {
+		row, err := p.feeder.row(index, r)
+		if err != nil {
+			return nil, err
+		}
+		for field, value := range row {
+			data[field] = value
+		}
+	}
+	data["index"] = index
+	data["seq"] = int64(0)
+	data["stamp"] = ""
+
+	return data, nil
+}
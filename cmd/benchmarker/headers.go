@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+var (
+	// Handshake headers managed by the websocket dialer.
+	reservedHeaders = map[string]bool{
+		"Upgrade":                  true,
+		"Connection":               true,
+		"Sec-Websocket-Key":        true,
+		"Sec-Websocket-Version":    true,
+		"Sec-Websocket-Extensions": true,
+		"Sec-Websocket-Protocol":   true,
+	}
+)
+
+// parseHeaders parses a list of "Name: value" handshake headers. Values are
+// templates rendered for every connection.
+func parseHeaders(raw []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, h := range raw {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q: expected \"Name: value\"", h)
+		}
+
+		name := http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		if reservedHeaders[name] {
+			return nil, fmt.Errorf("invalid header %q: %s is set by the websocket handshake", h, name)
+		}
+		headers.Add(name, strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+// addCookies adds a Cookie header joining the given "name=value" cookies.
+func addCookies(headers http.Header, cookies []string) error {
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	for _, c := range cookies {
+		if i := strings.Index(c, "="); i <= 0 {
+			return fmt.Errorf("invalid cookie %q: expected name=value", c)
+		}
+	}
+
+	headers.Add("Cookie", strings.Join(cookies, "; "))
+	return nil
+}
+
+// headerTemplates are compiled handshake header value templates.
+type headerTemplates map[string][]*compiledTemplate
+
+// compileHeaders compiles the header value templates.
+func compileHeaders(headers http.Header) (headerTemplates, error) {
+	compiled := make(headerTemplates, len(headers))
+	for name, values := range headers {
+		for _, v := range values {
+			t, err := compileTemplate(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid header %s: %v", name, err)
+			}
+			compiled[name] = append(compiled[name], t)
+		}
+	}
+	return compiled, nil
+}
+
+// bind returns the header templates with their random functions drawing
+// from r.
+func (h headerTemplates) bind(r *rand.Rand) headerTemplates {
+	bound := make(headerTemplates, len(h))
+	for name, values := range h {
+		for _, t := range values {
+			bound[name] = append(bound[name], t.bind(r))
+		}
+	}
+	return bound
+}
+
+// render renders the header values for the given connection.
+func (h headerTemplates) render(data interface{}) (http.Header, error) {
+	rendered := make(http.Header, len(h))
+	for name, values := range h {
+		for _, t := range values {
+			b, err := t.render(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid header %s: %w", name, err)
+			}
+			rendered.Add(name, string(b))
+		}
+	}
+	return rendered, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+)
+
+const (
+	// How often round trip latencies are logged.
+	latencyReportInterval = 10 * time.Second
+
+	// Maximum number of unanswered messages tracked per connection, older ones
+	// are considered lost.
+	maxPendingReplies = 1024
+
+	// Maximum length of a stamp, the largest tracker id, sequence number and
+	// send time included.
+	maxStampSize = len("#rtt:") + 20 + len(":") + 20 + len(":") + 19 + len("#")
+)
+
+var (
+	// Stamps placed in outgoing messages look like
+	// "#rtt:<tracker>:<seq>:<unixnano>#".
+	stampPrefix = []byte("#rtt:")
+	stampSuffix = []byte("#")
+
+	// Last tracker id handed out.
+	lastTrackerID uint64
+)
+
+// latency aggregates round trip times measured by every connection.
+type latency struct {
+	histogram *util.Histogram
+
+	// Messages that never got a reply.
+	unanswered int64
+}
+
+// newLatency creates an empty latency aggregate
+func newLatency() *latency {
+	return &latency{histogram: util.NewHistogram()}
+}
+
+// latencyStats is a snapshot of the round trip statistics.
+type latencyStats struct {
+	util.HistogramSnapshot
+	Unanswered int64 `json:"unanswered"`
+}
+
+// stats returns a snapshot of the round trip statistics.
+func (l *latency) stats() latencyStats {
+	return latencyStats{
+		HistogramSnapshot: l.histogram.Snapshot(),
+		Unanswered:        atomic.LoadInt64(&l.unanswered),
+	}
+}
+
+// report periodically logs round trip latencies until quitting is closed.
+func (l *latency) report(quitting chan struct{}) {
+	ticker := time.NewTicker(latencyReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quitting:
+			return
+		case <-ticker.C:
+		}
+
+		s := l.stats()
+		log.Printf(
+			"Round trips: %d answered, %d unanswered, p50=%v p90=%v p99=%v p99.9=%v max=%v\n",
+			s.Count, s.Unanswered, s.P50, s.P90, s.P99, s.P999, s.Max,
+		)
+	}
+}
+
+// latencyTracker stamps the messages sent by a connection with its id, a
+// sequence number and the send time, and matches replies carrying the same
+// stamp, ignoring those of other connections (e.g. through fan-out targets).
+// It is not safe for concurrent use.
+type latencyTracker struct {
+	latency *latency
+	id      uint64
+	seq     uint64
+	oldest  uint64
+	pending map[uint64]time.Time
+}
+
+// newLatencyTracker creates a tracker recording into the given aggregate.
+func newLatencyTracker(l *latency) *latencyTracker {
+	return &latencyTracker{
+		latency: l,
+		id:      atomic.AddUint64(&lastTrackerID, 1),
+		pending: make(map[uint64]time.Time),
+	}
+}
+
+// stamp returns the stamp of the next message, along with its sequence
+// number and send time. The message is only tracked once track is called,
+// after it has actually been sent.
+func (t *latencyTracker) stamp() (uint64, time.Time, []byte) {
+	now := time.Now()
+	t.seq++
+
+	b := make([]byte, 0, maxStampSize)
+	b = append(b, stampPrefix...)
+	b = strconv.AppendUint(b, t.id, 10)
+	b = append(b, ':')
+	b = strconv.AppendUint(b, t.seq, 10)
+	b = append(b, ':')
+	b = strconv.AppendInt(b, now.UnixNano(), 10)
+	b = append(b, stampSuffix...)
+	return t.seq, now, b
+}
+
+// track marks a stamped message as sent and pending a reply.
+func (t *latencyTracker) track(seq uint64, sent time.Time) {
+	t.pending[seq] = sent
+
+	for len(t.pending) > maxPendingReplies {
+		if _, ok := t.pending[t.oldest]; ok {
+			delete(t.pending, t.oldest)
+			atomic.AddInt64(&t.latency.unanswered, 1)
+		}
+		t.oldest++
+	}
+}
+
+// match looks for a stamp in a received message and records the round trip
+// time if it belongs to a pending message of this tracker, sent at the
+// stamped time.
+func (t *latencyTracker) match(data []byte) {
+	i := bytes.Index(data, stampPrefix)
+	if i < 0 {
+		return
+	}
+	data = data[i+len(stampPrefix):]
+
+	i = bytes.Index(data, stampSuffix)
+	if i < 0 {
+		return
+	}
+
+	fields := bytes.Split(data[:i], []byte(":"))
+	if len(fields) != 3 {
+		return
+	}
+
+	id, err := strconv.ParseUint(string(fields[0]), 10, 64)
+	if err != nil || id != t.id {
+		return
+	}
+
+	seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return
+	}
+
+	stamped, err := strconv.ParseInt(string(fields[2]), 10, 64)
+	if err != nil {
+		return
+	}
+
+	sent, ok := t.pending[seq]
+	if !ok || sent.UnixNano() != stamped {
+		return
+	}
+	delete(t.pending, seq)
+
+	rtt := time.Since(sent)
+	t.latency.histogram.Record(rtt)
+	wsRoundTripDuration.Observe(rtt.Seconds())
+}
+
+// close accounts the messages still pending as unanswered.
+func (t *latencyTracker) close() {
+	atomic.AddInt64(&t.latency.unanswered, int64(len(t.pending)))
+	t.pending = nil
+}
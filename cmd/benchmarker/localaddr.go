@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// Maximum number of local addresses a CIDR can expand to.
+	maxLocalAddresses = 1 << 16
+)
+
+// portsExhaustedError is a dial failing with EADDRNOTAVAIL, or EADDRINUSE when
+// bound to a local address, because every ephemeral port of the local address
+// is in use.
+type portsExhaustedError struct {
+	local net.IP
+	err   error
+}
+
+func (e *portsExhaustedError) Error() string {
+	if e.local == nil {
+		return fmt.Sprintf("ephemeral ports exhausted, spread connections over more source addresses with --local-address: %v", e.err)
+	}
+	return fmt.Sprintf("ephemeral ports of local address %s exhausted, add more source addresses with --local-address: %v", e.local, e.err)
+}
+
+// parseLocalAddresses parses a list of local IP addresses or CIDR ranges to
+// bind connections to. Every address must be assigned to a local interface.
+func parseLocalAddresses(raw []string) ([]net.IP, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	local, err := newLocalAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, s := range raw {
+		for _, part := range strings.Split(s, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			expanded, err := expandAddress(part)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range expanded {
+				if !local.assigned(ip) {
+					return nil, fmt.Errorf("invalid local address %s: not assigned to any interface", ip)
+				}
+			}
+
+			ips = append(ips, expanded...)
+			if len(ips) > maxLocalAddresses {
+				return nil, fmt.Errorf("invalid local addresses: more than %d", maxLocalAddresses)
+			}
+		}
+	}
+
+	return ips, nil
+}
+
+// expandAddress returns the addresses of an IP or CIDR range, skipping the
+// network and broadcast addresses of IPv4 ranges.
+func expandAddress(s string) ([]net.IP, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q: expected an IP address or CIDR range", s)
+		}
+		return []net.IP{ip}, nil
+	}
+
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q: %v", s, err)
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("invalid local address %q: ranges larger than /%d are not supported", s, bits-16)
+	}
+
+	var ips []net.IP
+	for ip := ip.Mask(network.Mask); network.Contains(ip); ip = nextIP(ip) {
+		ips = append(ips, ip)
+	}
+	if ip.To4() != nil && bits-ones > 1 {
+		ips = ips[1 : len(ips)-1]
+	}
+
+	return ips, nil
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// localAddresses are the addresses connections can be bound to.
+type localAddresses struct {
+	ips map[string]bool
+
+	// Loopback ranges, all of whose addresses can be bound to.
+	loopbacks []*net.IPNet
+}
+
+func newLocalAddresses() (*localAddresses, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	local := &localAddresses{ips: make(map[string]bool, len(addrs))}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		local.ips[ipNet.IP.String()] = true
+		if ipNet.IP.IsLoopback() {
+			local.loopbacks = append(local.loopbacks, ipNet)
+		}
+	}
+	return local, nil
+}
+
+// assigned reports whether ip can be bound to.
+func (l *localAddresses) assigned(ip net.IP) bool {
+	if l.ips[ip.String()] {
+		return true
+	}
+	for _, loopback := range l.loopbacks {
+		if loopback.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
@@ -11,11 +10,10 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/glerchundi/loadtesting-ws/util"
-	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/pflag"
 	"gopkg.in/tylerb/graceful.v1"
 )
@@ -24,6 +22,14 @@ const (
 	cliName = "benchmarker"
 )
 
+// Exit codes
+const (
+	exitOK = iota
+	exitError
+	exitIncomplete
+	exitThresholds
+)
+
 var (
 	Version = "0.0.0"
 	GitRev  = "----------------------------------------"
@@ -38,12 +44,88 @@ func main() {
 	var origin string = ""
 	var connections int = 1
 	var concurrency int = 1
+	var stagesRaw string = ""
+	var rate float64 = 0
+	var maxInFlight int = 0
+	var arrivalProcess string = "fixed"
+	var schedule string = ""
+	var payload string = ""
+	var payloadType string = "text"
+	var measureLatency bool = false
+	var readLimit int64 = util.DefaultReadLimit
+	var reportFile string = ""
+	var duration time.Duration = 0
+	var maxMessages int64 = 0
+	var drainTimeout time.Duration = 60 * time.Second
+	var thresholdsRaw []string
+	var reconnectPolicy string = "none"
+	var reconnectDelay time.Duration = 1 * time.Second
+	var reconnectMaxDelay time.Duration = 30 * time.Second
+	var reconnectMaxAttempts int = 0
+	var scenarioFile string = ""
+	var headersRaw []string
+	var cookies []string
+	var bearerToken string = ""
+	var feederFile string = ""
+	var feederMode string = "round-robin"
+	var seed int64 = 0
+	var tlsOpts tlsOptions
+	var subprotocols []string
+	var proxy string = ""
+	var localAddrsRaw []string
+	var connectTimeout time.Duration = 10 * time.Second
+	var tlsTimeout time.Duration = 10 * time.Second
+	var upgradeTimeout time.Duration = 10 * time.Second
+	var connectRetries int = 0
+	var connectRetryDelay time.Duration = 1 * time.Second
 
 	fs := pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
 	fs.IntVar(&port, "port", port, "")
+	fs.StringVar(&scenarioFile, "scenario", scenarioFile, "JSON (or YAML if named *.yaml or *.yml) scenario file describing the run, flags set on the command line take precedence")
+	fs.StringArrayVar(&headersRaw, "header", headersRaw, "extra handshake header as \"Name: value\", the value is a template rendered per connection, can be repeated")
+	fs.StringArrayVar(&cookies, "cookie", cookies, "handshake cookie as name=value, the value is a template rendered per connection, can be repeated")
+	fs.StringVar(&bearerToken, "bearer-token", bearerToken, "template of a token sent as \"Authorization: Bearer <token>\" during the handshake")
 	fs.StringVar(&origin, "origin", origin, "")
+	fs.StringArrayVar(&subprotocols, "subprotocol", subprotocols, "subprotocol requested during the handshake, in order of preference, connections fail unless the server selects one of them, can be repeated")
+	fs.StringVar(&feederFile, "feeder", feederFile, "CSV or JSON Lines file whose rows are handed to connections as template data (e.g. {{.user_id}}), along with {{.index}}")
+	fs.StringVar(&feederMode, "feeder-mode", feederMode, "how feeder rows are handed to connections: round-robin, random or unique")
+	fs.Int64Var(&seed, "seed", seed, "random source seed for templates, feeders, send schedules and backoff jitter, every connection draws from its own source derived from it and its index, 0 picks one (reported) so the run can be reproduced")
+	fs.StringVar(&proxy, "proxy", proxy, "proxy to tunnel connections through as http://[user:password@]host:port (HTTP CONNECT) or socks5://[user:password@]host:port, defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment")
+	fs.StringArrayVar(&localAddrsRaw, "local-address", localAddrsRaw, "local IP address or CIDR range to bind connections to round robin, to open more connections than ephemeral ports of a single address, can be repeated")
+	fs.DurationVar(&connectTimeout, "connect-timeout", connectTimeout, "time allowed to resolve and connect to a target (or its proxy, opening the tunnel included), 0 waits forever")
+	fs.DurationVar(&tlsTimeout, "tls-timeout", tlsTimeout, "time allowed for TLS handshakes, 0 waits forever")
+	fs.DurationVar(&upgradeTimeout, "upgrade-timeout", upgradeTimeout, "time allowed for websocket upgrade responses, 0 waits forever")
+	fs.IntVar(&connectRetries, "connect-retries", connectRetries, "times a failed new connection is retried before giving up, reconnections follow the reconnect policy instead")
+	fs.DurationVar(&connectRetryDelay, "connect-retry-delay", connectRetryDelay, "delay between retries of a failed new connection")
+	fs.StringVar(&tlsOpts.caFile, "tls-ca-file", "", "PEM bundle of CAs trusted to verify wss:// targets, instead of the system roots")
+	fs.StringVar(&tlsOpts.certFile, "tls-cert-file", "", "PEM client certificate for mutual TLS")
+	fs.StringVar(&tlsOpts.keyFile, "tls-key-file", "", "PEM client certificate key for mutual TLS")
+	fs.BoolVar(&tlsOpts.insecureSkipVerify, "tls-insecure-skip-verify", false, "do not verify the certificates of wss:// targets")
+	fs.StringVar(&tlsOpts.serverName, "tls-server-name", "", "server name sent as SNI and verified, instead of the target host")
+	fs.StringVar(&tlsOpts.minVersion, "tls-min-version", "", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&tlsOpts.maxVersion, "tls-max-version", "", "maximum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&tlsOpts.ciphers, "tls-ciphers", "", "comma separated TLS 1.0-1.2 cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)")
+	fs.IntVar(&tlsOpts.sessionCache, "tls-session-cache", 0, "size of the TLS session cache shared by connections to resume sessions, 0 disables resumption")
 	fs.IntVar(&concurrency, "concurrency", concurrency, "")
 	fs.IntVar(&connections, "connections", connections, "")
+	fs.Float64Var(&rate, "rate", rate, "target connection attempts per second, started as they are due, 0 dials as fast as concurrency workers allow")
+	fs.IntVar(&maxInFlight, "max-in-flight", maxInFlight, "maximum connection attempts in flight when rate is set, later arrivals wait (and lag) for one to finish, 0 is unlimited")
+	fs.StringVar(&arrivalProcess, "arrival-process", arrivalProcess, "distribution of connection attempts when rate is set: fixed or poisson")
+	fs.StringVar(&schedule, "send-schedule", schedule, "per connection message schedule: interval:<duration>, rate:<per second>, think:exp:<mean>, think:uniform:<min>:<max> or think:normal:<mean>:<stddev>")
+	fs.StringVar(&payload, "payload", payload, "message payload template, rendered per connection ({{.seq}} is the message sequence number, {{.stamp}} its latency stamp)")
+	fs.StringVar(&payloadType, "payload-type", payloadType, "type of the workload and script messages: text or binary")
+	fs.Int64Var(&readLimit, "read-limit", readLimit, "maximum size of received messages, connections receiving larger ones fail, and of sent ones, stamps included, as echoing targets are expected to read as much")
+	fs.BoolVar(&measureLatency, "measure-latency", measureLatency, "stamp sent messages and measure the round trip time of replies carrying the same stamp, placed by the payload as {{.stamp}} or prepended to it (requires send-schedule)")
+	fs.StringVar(&reconnectPolicy, "reconnect", reconnectPolicy, "reconnect dropped connections: none, immediate, fixed, exponential or jittered")
+	fs.DurationVar(&reconnectDelay, "reconnect-delay", reconnectDelay, "delay between reconnection attempts, initial one for exponential policies")
+	fs.DurationVar(&reconnectMaxDelay, "reconnect-max-delay", reconnectMaxDelay, "maximum delay between reconnection attempts for exponential policies")
+	fs.IntVar(&reconnectMaxAttempts, "reconnect-max-attempts", reconnectMaxAttempts, "reconnection attempts before giving up, 0 retries forever")
+	fs.StringVar(&stagesRaw, "stages", stagesRaw, "comma separated load profile stages as duration:target (e.g. 5m:10000,20m:10000,2m:0)")
+	fs.DurationVar(&duration, "duration", duration, "stop the run after this duration, 0 runs until interrupted")
+	fs.Int64Var(&maxMessages, "max-messages", maxMessages, "stop the run after sending this many messages, 0 is unlimited")
+	fs.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "time allowed for connections to close when stopping")
+	fs.StringArrayVar(&thresholdsRaw, "threshold", thresholdsRaw, "pass/fail condition as <metric><op><value> (e.g. connect_error_rate<0.1%, rtt_p99<200ms), can be repeated")
+	fs.StringVar(&reportFile, "report-file", reportFile, "write the end of run report as JSON to this file")
 
 	// set normalization func
 	fs.SetNormalizeFunc(
@@ -65,43 +147,253 @@ func main() {
 
 	// parse
 	fs.Parse(os.Args[1:])
-	if len(fs.Args()) == 0 {
+
+	// get scenario
+	var script []scriptAction
+	targets := fs.Args()
+	if scenarioFile != "" {
+		sc, err := loadScenario(scenarioFile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if err := sc.apply(fs); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if script, err = compileScript(sc.Script); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if len(targets) == 0 {
+			targets = sc.Targets
+		}
+	}
+
+	if len(targets) == 0 {
 		fs.Usage()
 		os.Exit(1)
 	}
 
-	// get url
-	url := fs.Arg(0)
+	// seed random source
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// get handshake headers
+	headers, err := parseHeaders(headersRaw)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if err := addCookies(headers, cookies); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if bearerToken != "" {
+		headers.Set("Authorization", "Bearer "+bearerToken)
+	}
+	headerTemplates, err := compileHeaders(headers)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	// get endpoint and origin templates
+	var targetTemplates []*compiledTemplate
+	for _, target := range targets {
+		t, err := compileTemplate(target)
+		if err != nil {
+			log.Fatalf("invalid target %s: %v\n", target, err)
+		}
+		targetTemplates = append(targetTemplates, t)
+	}
+	var originTemplate *compiledTemplate
+	if origin != "" {
+		originTemplate, err = compileTemplate(origin)
+		if err != nil {
+			log.Fatalf("invalid origin %s: %v\n", origin, err)
+		}
+	}
+
+	// get template data feeder
+	var feeder *feeder
+	if feederFile != "" {
+		feeder, err = loadFeeder(feederFile, feederMode)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	// get TLS configuration
+	tlsConfig, err := newTLSConfig(tlsOpts)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	// get proxy
+	var proxyURL *url.URL
+	if proxy != "" {
+		proxyURL, err = parseProxy(proxy)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	if readLimit < 1 {
+		log.Fatalf("invalid read-limit %d: must be positive\n", readLimit)
+	}
+
+	messageType, err := parsePayloadType(payloadType)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	if concurrency < 1 {
+		log.Fatalf("invalid concurrency %d: must be at least 1\n", concurrency)
+	}
+
+	if maxInFlight < 0 {
+		log.Fatalf("invalid max-in-flight %d: must not be negative\n", maxInFlight)
+	}
+
+	if connectRetries < 0 {
+		log.Fatalf("invalid connect-retries %d: must not be negative\n", connectRetries)
+	}
+
+	// get local addresses
+	localAddrs, err := parseLocalAddresses(localAddrsRaw)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	// get load profile
+	stages, err := parseStages(stagesRaw)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	// get pass/fail thresholds
+	var thresholds []*threshold
+	for _, raw := range thresholdsRaw {
+		t, err := parseThreshold(raw)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		thresholds = append(thresholds, t)
+	}
+
+	// get arrival rate
+	var arrivals *arrivals
+	if rate > 0 {
+		arrivals, err = newArrivals(rate, arrivalProcess, seed)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	// get reconnection policy
+	var reconnect *backoff
+	if reconnectPolicy != "none" {
+		reconnect, err = newBackoff(reconnectPolicy, reconnectDelay, reconnectMaxDelay, reconnectMaxAttempts)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	// get workload
+	var workload *workload
+	if schedule != "" {
+		workload, err = newWorkload(schedule, payload, int(readLimit), measureLatency)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	// get latency measurement
+	var latency *latency
+	if measureLatency {
+		if workload == nil {
+			log.Fatalf("measure-latency requires a send-schedule\n")
+		}
+		latency = newLatency()
+	}
 
 	// graceful termination utilites
 	waitGroup := util.NewWaitGroup()
 	quitting := make(chan struct{})
-	connsCh := make(chan int)
-
-	// create main creator loop
-	go func(url, origin string, concurrency int, waitGroup *util.WaitGroup, quitting chan struct{}) {
-		for {
-			select {
-			case <-quitting:
-				return
-			case connections, ok := <-connsCh:
-				if !ok {
-					return
-				}
-
-				createConnections(url, origin, concurrency, connections, waitGroup, quitting)
-			}
-		}
-	}(url, origin, concurrency, waitGroup, quitting)
+
+	// create connection pool
+	pool := newPool(targetTemplates, originTemplate, concurrency, waitGroup, quitting)
+	pool.headers = headerTemplates
+	pool.dialer = newDialer(tlsConfig)
+	pool.dialer.subprotocols = subprotocols
+	pool.dialer.proxy = proxyURL
+	pool.dialer.localAddrs = localAddrs
+	pool.dialer.connectTimeout = connectTimeout
+	pool.dialer.tlsTimeout = tlsTimeout
+	pool.dialer.upgradeTimeout = upgradeTimeout
+	pool.retries = connectRetries
+	pool.retryDelay = connectRetryDelay
+	pool.feeder = feeder
+	pool.script = script
+	pool.arrivals = arrivals
+	pool.maxInFlight = maxInFlight
+	pool.seed = seed
+	pool.readLimit = readLimit
+	pool.messageType = messageType
+	pool.workload = workload
+	pool.latency = latency
+	pool.maxMessages = maxMessages
+	pool.reconnect = reconnect
+	pool.Run()
+
+	// run configuration
+	cfg := runConfig{
+		Targets:        targets,
+		Scenario:       scenarioFile,
+		Origin:         origin,
+		Subprotocols:   subprotocols,
+		LocalAddresses: localAddrsRaw,
+		Seed:           seed,
+		Feeder:         feederFile,
+		Connections:    connections,
+		Concurrency:    concurrency,
+		Stages:         stagesRaw,
+		SendSchedule:   schedule,
+		MeasureLatency: measureLatency,
+		ReadLimit:      readLimit,
+		ConnectTimeout: connectTimeout,
+		TLSTimeout:     tlsTimeout,
+		UpgradeTimeout: upgradeTimeout,
+		ConnectRetries: connectRetries,
+	}
+	if reconnect != nil {
+		cfg.Reconnect = reconnectPolicy
+	}
+	if proxyURL != nil {
+		cfg.Proxy = proxyURL.Redacted()
+	}
+	if feeder != nil {
+		cfg.FeederMode = feederMode
+	}
+	if arrivals != nil {
+		cfg.Rate = rate
+		cfg.ArrivalProcess = arrivalProcess
+		cfg.MaxInFlight = maxInFlight
+	}
+	if workload != nil || script != nil {
+		cfg.PayloadType = payloadType
+	}
 
 	// start justin tunnel bench
+	start := time.Now()
 	log.Println("Benchmarker started")
-	defer log.Println("Benchmarker stopped")
 
 	// create first connections
-	connsCh <- connections
+	pool.add(connections)
+
+	// execute load profile
+	if len(stages) > 0 {
+		go pool.runStages(stages)
+	}
 
 	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
 	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte{})
@@ -111,10 +403,13 @@ func main() {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte{})
 		} else {
-			connsCh <- n
+			pool.add(n)
 		}
 	})
 
+	controller := &controller{pool: pool, cfg: cfg, start: start}
+	controller.register(mux)
+
 	server := &graceful.Server{
 		Timeout: 10 * time.Second,
 		Server: &http.Server{
@@ -123,138 +418,79 @@ func main() {
 		},
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("%v\n", err)
-	}
-
-	// close existing websocket connections
-	close(quitting)
-
-	// block until
-	err := waitGroup.WaitTimeout(60 * time.Second)
-	if err != nil {
-		log.Fatalf("%v\n", err)
-	}
-}
-
-func createConnections(url, origin string, concurrency, connections int, waitGroup *util.WaitGroup, quitting chan struct{}) {
-	connsPerRoutine := int(connections / concurrency)
-	for i := 0; i < concurrency; i++ {
-		currentConnsPerRoutine := connsPerRoutine
-		if i == concurrency-1 {
-			currentConnsPerRoutine = connections - i*connsPerRoutine
+	// stop automatically once the run limits are reached
+	stopReasons := make(chan string, 1)
+	stopped := make(chan struct{})
+	go func() {
+		var elapsed <-chan time.Time
+		if duration > 0 {
+			timer := time.NewTimer(duration)
+			defer timer.Stop()
+			elapsed = timer.C
 		}
 
-		go func(i, count, countPerRoutine int) {
-			for j := 0; j < count; j++ {
-				err := connectAndHandle(i*countPerRoutine+j, url, origin, waitGroup, quitting)
-				if err != nil {
-					log.Printf("%v\n", err)
-				}
-			}
-		}(i, currentConnsPerRoutine, connsPerRoutine)
-	}
-}
+		var reason string
+		select {
+		case <-stopped:
+			return
+		case <-elapsed:
+			reason = "duration elapsed"
+		case <-pool.Exhausted():
+			reason = "message limit reached"
+		}
 
-func connectAndHandle(index int, templateURL, origin string, waitGroup *util.WaitGroup, quitting chan struct{}) error {
-	endpointRaw, err := parseWithData(templateURL, &index)
-	if err != nil {
-		return err
-	}
-	endpoint := string(endpointRaw)
+		log.Printf("Stopping: %s\n", reason)
+		stopReasons <- reason
+		server.Stop(server.Timeout)
+	}()
 
-	endpointURL, err := url.Parse(endpoint)
-	if err != nil {
-		return err
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("%v\n", err)
 	}
+	close(stopped)
 
-	if origin == "" {
-		originURL := *endpointURL
-		if endpointURL.Scheme == "wss" {
-			originURL.Scheme = "https"
-		} else {
-			originURL.Scheme = "http"
-		}
-		origin = originURL.String()
+	stopReason := "interrupted"
+	select {
+	case stopReason = <-stopReasons:
+	default:
 	}
 
-	headers := make(http.Header)
-	headers.Add("Origin", origin)
+	// close existing websocket connections
+	close(quitting)
 
-	log.Printf("Trying to connect to: %s\n", endpoint)
+	// block until
+	waitErr := waitGroup.WaitTimeout(drainTimeout)
 
-	conn, _, err := websocket.DefaultDialer.Dial(endpoint, headers)
+	// summarize the run
+	report, err := newReport(cfg, pool, start, time.Now())
 	if err != nil {
-		return err
+		log.Fatalf("%v\n", err)
 	}
+	report.StopReason = stopReason
 
-	ws := util.NewWebSocketClient(conn)
-	ws.Run()
-
-	log.Printf("Connected to: %s\n", endpoint)
+	code := exitOK
+	if waitErr != nil {
+		log.Printf("Connections did not close in time: %v\n", waitErr)
+		code = exitIncomplete
+	}
 
-	go func() {
-		defer log.Printf("Disconnected from: %s\n", endpoint)
-
-		waitGroup.Add(1)
-		defer waitGroup.Done()
-
-		ticker := time.NewTimer(500 * time.Millisecond)
-		defer ticker.Stop()
-
-		isQuitting := false
-		for {
-		L:
-			select {
-			case _, ok := <-ws.ReadMessage():
-				if !ok {
-					return
-				}
-			case <-ticker.C:
-				select {
-				case <-quitting:
-					if isQuitting {
-						break L
-					}
-
-					// send close message for graceful termination
-					ws.SendMessage(&util.Message{
-						websocket.CloseMessage,
-						websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
-					})
-					isQuitting = true
-				}
+	if !checkThresholds(thresholds, report) {
+		for _, t := range report.Thresholds {
+			if !t.Passed {
+				log.Printf("Threshold failed: %s\n", t.Threshold)
 			}
 		}
-	}()
-
-	return nil
-}
-
-var (
-	letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	tmplFuncs   = template.FuncMap{
-		"randomString": func(n int) string {
-			b := make([]rune, n)
-			for i := range b {
-				b[i] = letterRunes[rand.Intn(len(letterRunes))]
-			}
-			return string(b)
-		},
-	}
-)
-
-func parseWithData(s string, data interface{}) ([]byte, error) {
-	tmpl, err := template.New("test").Funcs(tmplFuncs).Parse(s)
-	if err != nil {
-		return nil, err
+		code = exitThresholds
 	}
 
-	b := &bytes.Buffer{}
-	err = tmpl.Execute(b, data)
-	if err != nil {
-		return nil, err
+	report.print(os.Stdout)
+	if reportFile != "" {
+		if err := report.writeJSON(reportFile); err != nil {
+			log.Printf("%v\n", err)
+			code = exitError
+		}
 	}
 
-	return b.Bytes(), nil
+	log.Println("Benchmarker stopped")
+	os.Exit(code)
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Buckets for durations between 1ms and ~32s.
+	durationBuckets = prometheus.ExponentialBuckets(0.001, 2, 16)
+
+	wsConnectionsAttempted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_connections_attempted",
+			Help: "Total number of connection attempts.",
+		},
+	)
+
+	wsConnectionsEstablished = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_connections_established",
+			Help: "Total number of established connections.",
+		},
+	)
+
+	wsConnectionsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_connections_failed",
+			Help: "Failed number of connections by error class.",
+		},
+		[]string{"class"},
+	)
+
+	wsConnectRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_connect_retries",
+			Help: "Total number of retried connection attempts.",
+		},
+	)
+
+	wsConnectionsEstablishedOnRetry = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_connections_established_on_retry",
+			Help: "Total number of connections established by a retry rather than the first attempt.",
+		},
+	)
+
+	wsConnectionsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_connections_dropped",
+			Help: "Total number of established connections dropped by errors, by error class.",
+		},
+		[]string{"class"},
+	)
+
+	wsConnectionsClosed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_connections_closed",
+			Help: "Total number of closed connections.",
+		},
+	)
+
+	wsConnectionsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ws_connections_active",
+			Help: "Total number of connections.",
+		},
+	)
+
+	wsDialDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_dial_duration_seconds",
+			Help:    "Time spent establishing connections, handshake included.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsDNSDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_dns_duration_seconds",
+			Help:    "Time spent resolving host names.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsTCPConnectDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_tcp_connect_duration_seconds",
+			Help:    "Time spent opening TCP connections.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsProxyConnectDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_proxy_connect_duration_seconds",
+			Help:    "Time spent opening tunnels through proxies.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsTLSHandshakeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_tls_handshake_duration_seconds",
+			Help:    "Time spent in TLS handshakes.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsTLSHandshakes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_tls_handshakes",
+			Help: "Total number of completed TLS handshakes.",
+		},
+	)
+
+	wsTLSResumed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_tls_resumed",
+			Help: "Total number of TLS handshakes resuming a previous session.",
+		},
+	)
+
+	wsUpgradeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_upgrade_duration_seconds",
+			Help:    "Time spent in websocket upgrade requests, TLS excluded.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsReconnectAttempts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_reconnect_attempts",
+			Help: "Total number of attempts to reconnect dropped connections.",
+		},
+	)
+
+	wsReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_reconnects",
+			Help: "Total number of dropped connections reconnected.",
+		},
+	)
+
+	wsReconnectsAbandoned = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_reconnects_abandoned",
+			Help: "Total number of dropped connections given up after the maximum attempts.",
+		},
+	)
+
+	wsReconnectDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_reconnect_duration_seconds",
+			Help:    "Time from a connection being dropped until it is reconnected.",
+			Buckets: durationBuckets,
+		},
+	)
+
+	wsScriptsCompleted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_scripts_completed",
+			Help: "Total number of connection scripts completed.",
+		},
+	)
+
+	wsScriptsFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_scripts_failed",
+			Help: "Total number of connection scripts failed.",
+		},
+	)
+
+	wsMessagesSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_messages_sent",
+			Help: "Total number of messages sent.",
+		},
+	)
+
+	wsMessagesReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_messages_received",
+			Help: "Total number of messages received.",
+		},
+	)
+
+	wsBytesSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_bytes_sent",
+			Help: "Total number of payload bytes sent.",
+		},
+	)
+
+	wsBytesReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_bytes_received",
+			Help: "Total number of payload bytes received.",
+		},
+	)
+
+	wsRoundTripDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ws_round_trip_seconds",
+			Help:    "Round trip time of stamped messages.",
+			Buckets: durationBuckets,
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(wsConnectionsAttempted)
+	prometheus.MustRegister(wsConnectionsEstablished)
+	prometheus.MustRegister(wsConnectionsFailed)
+	prometheus.MustRegister(wsConnectRetries)
+	prometheus.MustRegister(wsConnectionsEstablishedOnRetry)
+	prometheus.MustRegister(wsConnectionsDropped)
+	prometheus.MustRegister(wsConnectionsClosed)
+	prometheus.MustRegister(wsConnectionsActive)
+	prometheus.MustRegister(wsDialDuration)
+	prometheus.MustRegister(wsDNSDuration)
+	prometheus.MustRegister(wsTCPConnectDuration)
+	prometheus.MustRegister(wsProxyConnectDuration)
+	prometheus.MustRegister(wsTLSHandshakeDuration)
+	prometheus.MustRegister(wsTLSHandshakes)
+	prometheus.MustRegister(wsTLSResumed)
+	prometheus.MustRegister(wsUpgradeDuration)
+	prometheus.MustRegister(wsReconnectAttempts)
+	prometheus.MustRegister(wsReconnects)
+	prometheus.MustRegister(wsReconnectsAbandoned)
+	prometheus.MustRegister(wsReconnectDuration)
+	prometheus.MustRegister(wsScriptsCompleted)
+	prometheus.MustRegister(wsScriptsFailed)
+	prometheus.MustRegister(wsMessagesSent)
+	prometheus.MustRegister(wsMessagesReceived)
+	prometheus.MustRegister(wsBytesSent)
+	prometheus.MustRegister(wsBytesReceived)
+	prometheus.MustRegister(wsRoundTripDuration)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+	"github.com/gorilla/websocket"
+)
+
+// pool keeps track of the benchmarker connections, creating or closing them
+// on demand.
+type pool struct {
+	sync.Mutex
+
+	origin      *compiledTemplate
+	concurrency int
+
+	waitGroup *util.WaitGroup
+	quitting  chan struct{}
+
+	// Paces connection attempts, nil dials as fast as workers are available.
+	// Paced attempts are started as they are due instead of waiting for a
+	// worker, bounded by maxInFlight simultaneous dials if positive.
+	arrivals    *arrivals
+	maxInFlight int
+	inFlight    chan struct{}
+
+	// Endpoint URL templates, connections are spread among them round robin.
+	targets []*compiledTemplate
+
+	// Extra handshake header templates.
+	headers headerTemplates
+
+	// Establishes the websocket connections.
+	dialer *dialer
+
+	// Maximum size of the messages read by the connections, and of the ones
+	// they send as echoing targets are expected to read as much.
+	readLimit int64
+
+	// Type of the messages sent by the connections.
+	messageType int
+
+	// Times a failed new connection is retried, and the delay in between.
+	retries    int
+	retryDelay time.Duration
+
+	// Rows handed to connections as template data, nil hands none.
+	feeder *feeder
+
+	// Seed the random source of every connection is derived from.
+	seed int64
+
+	// Steps run by every connection once established.
+	script []scriptAction
+
+	// Messages sent by every connection, nil sends nothing.
+	workload *workload
+
+	// Maximum number of messages sent by all connections, 0 is unlimited.
+	maxMessages int64
+
+	// Number of messages sent, or reserved while being sent, by all
+	// connections, and the number of those actually sent.
+	reserved int64
+	sent     int64
+
+	// Closed once maxMessages have been sent.
+	exhausted     chan struct{}
+	exhaustedOnce sync.Once
+
+	// Aggregates round trip times, nil when latency is not measured.
+	latency *latency
+
+	// Time spent establishing connections, and in each of their phases.
+	dials         *util.Histogram
+	dnsLookups    *util.Histogram
+	tcpConnects   *util.Histogram
+	proxyConnects *util.Histogram
+	tlsHandshakes *util.Histogram
+	upgrades      *util.Histogram
+
+	// Connection indexes ready to be dialed by the workers.
+	jobs chan int
+
+	// Signals the dispatcher that new connections have been queued.
+	wakeup chan struct{}
+
+	// Connections waiting to be dispatched.
+	queued int
+
+	// Connections being dialed.
+	dialing int
+
+	// Next connection index to assign.
+	next int
+
+	// Established connections.
+	conns map[*connection]struct{}
+
+	// Reconnects dropped connections, nil lets them go.
+	reconnect *backoff
+
+	// Connections waiting to be reconnected.
+	reconnecting int
+
+	// Reconnections to give up on, requested while removing connections.
+	abandoned int
+
+	// Time spent reconnecting dropped connections.
+	reconnects *util.Histogram
+}
+
+// connectionRand returns the random source of a connection, derived from the
+// run seed and the connection index so the values it draws do not depend on
+// how connections are scheduled.
+func (p *pool) connectionRand(index int) *rand.Rand {
+	// splitmix64 finalizer, so nearby seeds and indexes give unrelated sources
+	z := uint64(p.seed) + uint64(index+1)*0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return rand.New(rand.NewSource(int64(z ^ z>>31)))
+}
+
+// newPool creates a new connection pool
+func newPool(targets []*compiledTemplate, origin *compiledTemplate, concurrency int, waitGroup *util.WaitGroup, quitting chan struct{}) *pool {
+	return &pool{
+		targets:       targets,
+		origin:        origin,
+		concurrency:   concurrency,
+		waitGroup:     waitGroup,
+		quitting:      quitting,
+		jobs:          make(chan int),
+		wakeup:        make(chan struct{}, 1),
+		conns:         make(map[*connection]struct{}),
+		dialer:        newDialer(nil),
+		readLimit:     util.DefaultReadLimit,
+		messageType:   websocket.TextMessage,
+		dials:         util.NewHistogram(),
+		dnsLookups:    util.NewHistogram(),
+		tcpConnects:   util.NewHistogram(),
+		proxyConnects: util.NewHistogram(),
+		tlsHandshakes: util.NewHistogram(),
+		upgrades:      util.NewHistogram(),
+		exhausted:     make(chan struct{}),
+		reconnects:    util.NewHistogram(),
+	}
+}
+
+// Run starts the dispatcher and dialing workers without blocking
+func (p *pool) Run() {
+	if p.latency != nil {
+		go p.latency.report(p.quitting)
+	}
+	go p.dispatch()
+
+	if p.arrivals != nil {
+		if p.maxInFlight > 0 {
+			p.inFlight = make(chan struct{}, p.maxInFlight)
+		}
+		go p.arrivals.report(p.quitting)
+		return
+	}
+	for i := 0; i < p.concurrency; i++ {
+		go p.work()
+	}
+}
+
+// dispatch hands queued connections over to the workers, or starts them as
+// they are due when paced by arrivals.
+func (p *pool) dispatch() {
+	defer close(p.jobs)
+
+	for {
+		select {
+		case <-p.quitting:
+			return
+		case <-p.wakeup:
+		}
+
+		for {
+			var scheduled time.Time
+			if p.arrivals != nil && p.hasQueued() {
+				var ok bool
+				if scheduled, ok = p.arrivals.wait(p.quitting); !ok {
+					return
+				}
+			}
+
+			index, ok := p.dequeue()
+			if !ok {
+				if p.arrivals != nil {
+					p.arrivals.idle()
+				}
+				break
+			}
+
+			if p.arrivals != nil {
+				if !p.acquire() {
+					return
+				}
+				go p.arrive(index)
+				p.arrivals.started(scheduled)
+				continue
+			}
+
+			select {
+			case <-p.quitting:
+				return
+			case p.jobs <- index:
+			}
+		}
+	}
+}
+
+// hasQueued reports whether there are connections waiting to be dispatched.
+func (p *pool) hasQueued() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.queued > 0
+}
+
+// dequeue takes the next queued connection and marks it as dialing.
+func (p *pool) dequeue() (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.queued == 0 {
+		return 0, false
+	}
+
+	index := p.next
+	p.next++
+	p.queued--
+	p.dialing++
+	return index, true
+}
+
+// work dials every connection it receives until the pool stops dispatching.
+func (p *pool) work() {
+	for index := range p.jobs {
+		p.connectRetrying(index)
+		p.dialed()
+	}
+}
+
+// arrive dials a connection started by the arrival schedule, the dispatcher
+// already acquired its in flight slot.
+func (p *pool) arrive(index int) {
+	p.connectRetrying(index)
+	p.dialed()
+}
+
+// dialed marks a connection as no longer dialing.
+func (p *pool) dialed() {
+	p.Lock()
+	p.dialing--
+	p.Unlock()
+}
+
+// acquire takes an in flight slot for a paced connection attempt, waiting for
+// one to be released. It returns false if quitting is closed in the meantime.
+func (p *pool) acquire() bool {
+	if p.inFlight == nil {
+		return true
+	}
+	select {
+	case <-p.quitting:
+		return false
+	case p.inFlight <- struct{}{}:
+		return true
+	}
+}
+
+// release frees the in flight slot of a paced connection attempt.
+func (p *pool) release() {
+	if p.inFlight != nil {
+		<-p.inFlight
+	}
+}
+
+// add enqueues n new connections.
+func (p *pool) add(n int) {
+	if n <= 0 {
+		return
+	}
+
+	p.Lock()
+	p.queued += n
+	p.Unlock()
+
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// remove drops n connections, cancelling queued ones first and closing
+// established ones afterwards. Connections being dialed are not affected.
+func (p *pool) remove(n int) {
+	p.Lock()
+	defer p.Unlock()
+
+	cancelled := n
+	if cancelled > p.queued {
+		cancelled = p.queued
+	}
+	p.queued -= cancelled
+	n -= cancelled
+
+	for c := range p.conns {
+		if n <= 0 {
+			break
+		}
+		delete(p.conns, c)
+		c.Close()
+		n--
+	}
+
+	if n > p.reconnecting-p.abandoned {
+		n = p.reconnecting - p.abandoned
+	}
+	p.abandoned += n
+}
+
+// scale adds or removes connections until there are target of them.
+func (p *pool) scale(target int) {
+	if n := target - p.size(); n > 0 {
+		p.add(n)
+	} else if n < 0 {
+		p.remove(-n)
+	}
+}
+
+// poolStatus is a snapshot of the pool connections.
+type poolStatus struct {
+	Established  int `json:"established"`
+	Dialing      int `json:"dialing"`
+	Queued       int `json:"queued"`
+	Reconnecting int `json:"reconnecting"`
+}
+
+// status returns a snapshot of the pool connections.
+func (p *pool) status() poolStatus {
+	p.Lock()
+	defer p.Unlock()
+	return poolStatus{
+		Established:  len(p.conns),
+		Dialing:      p.dialing,
+		Queued:       p.queued,
+		Reconnecting: p.reconnecting - p.abandoned,
+	}
+}
+
+// size returns the number of established, dialing, queued and reconnecting
+// connections.
+func (p *pool) size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.conns) + p.dialing + p.queued + p.reconnecting - p.abandoned
+}
+
+// reserve accounts a message about to be sent, it returns false if the
+// message limit has already been reached. Reserved messages must be either
+// committed once sent or unreserved if sending failed.
+func (p *pool) reserve() bool {
+	for {
+		n := atomic.LoadInt64(&p.reserved)
+		if p.maxMessages > 0 && n >= p.maxMessages {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.reserved, n, n+1) {
+			return true
+		}
+	}
+}
+
+// unreserve gives back a reserved message that could not be sent.
+func (p *pool) unreserve() {
+	atomic.AddInt64(&p.reserved, -1)
+}
+
+// commit accounts a reserved message as sent, closing Exhausted once the
+// message limit is reached.
+func (p *pool) commit() {
+	if atomic.AddInt64(&p.sent, 1) == p.maxMessages {
+		p.exhaustedOnce.Do(func() {
+			close(p.exhausted)
+		})
+	}
+}
+
+// Exhausted returns a channel closed once the message limit is reached
+func (p *pool) Exhausted() <-chan struct{} {
+	return p.exhausted
+}
+
+// register starts tracking an established connection.
+func (p *pool) register(c *connection) {
+	p.Lock()
+	p.conns[c] = struct{}{}
+	p.Unlock()
+}
+
+// unregister stops tracking a connection once it is gone.
+func (p *pool) unregister(c *connection) {
+	p.Lock()
+	delete(p.conns, c)
+	p.Unlock()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	// SOCKS5 reply codes (RFC 1928).
+	socks5Replies = map[byte]string{
+		1: "general SOCKS server failure",
+		2: "connection not allowed by ruleset",
+		3: "network unreachable",
+		4: "host unreachable",
+		5: "connection refused",
+		6: "TTL expired",
+		7: "command not supported",
+		8: "address type not supported",
+	}
+)
+
+// proxyError is a failure to reach a target through its proxy, as opposed to
+// a failure of the target itself.
+type proxyError struct {
+	err error
+}
+
+func (e *proxyError) Error() string {
+	return fmt.Sprintf("proxy: %v", e.err)
+}
+
+// parseProxy parses an http:// (HTTP CONNECT) or socks5:// proxy URL, with
+// optional user:password credentials.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", s, err)
+	}
+
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: expected an http:// or socks5:// URL", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", s)
+	}
+
+	return u, nil
+}
+
+// proxyAddr returns the host:port address of a proxy.
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	port := "1080"
+	if proxyURL.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// openTunnel asks the proxy conn is connected to for a tunnel to addr.
+func openTunnel(conn net.Conn, proxyURL *url.URL, addr string) error {
+	switch proxyURL.Scheme {
+	case "http":
+		return httpConnect(conn, proxyURL, addr)
+	case "socks5", "socks5h":
+		return socks5Connect(conn, proxyURL, addr)
+	}
+	return fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The buffered reader can be discarded as the proxy sends nothing else
+	// until the client speaks.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect opens a tunnel to addr with a SOCKS5 CONNECT command, host
+// names are resolved by the proxy.
+func socks5Connect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	host, portRaw, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portRaw, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portRaw)
+	}
+
+	// negotiate authentication method
+	methods := []byte{0x00}
+	if proxyURL.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS version %d", b[0])
+	}
+
+	switch b[1] {
+	case 0x00:
+	case 0x02:
+		user := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if b[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	default:
+		return errors.New("no acceptable SOCKS5 authentication method")
+	}
+
+	// request connection
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		msg, ok := socks5Replies[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply code %d", reply[1])
+		}
+		return fmt.Errorf("SOCKS5 CONNECT %s: %s", addr, msg)
+	}
+
+	// skip the bound address
+	var skip int
+	switch reply[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		skip = int(b[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
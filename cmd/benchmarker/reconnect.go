@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// backoff decides how long to wait before each reconnection attempt.
+type backoff struct {
+	policy      string
+	delay       time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+}
+
+// newBackoff creates a reconnection backoff policy, one of:
+//
+//	immediate    reconnect right away
+//	fixed        wait delay between attempts
+//	exponential  double the delay on every attempt, up to maxDelay
+//	jittered     wait a random time between 0 and the exponential delay
+//
+// A maxAttempts of 0 retries forever.
+func newBackoff(policy string, delay, maxDelay time.Duration, maxAttempts int) (*backoff, error) {
+	switch policy {
+	case "immediate", "fixed", "exponential", "jittered":
+	default:
+		return nil, fmt.Errorf("invalid reconnect policy %q: expected none, immediate, fixed, exponential or jittered", policy)
+	}
+
+	if delay < 0 || maxDelay < 0 || maxAttempts < 0 {
+		return nil, fmt.Errorf("invalid reconnect policy: delays and attempts must not be negative")
+	}
+
+	return &backoff{
+		policy:      policy,
+		delay:       delay,
+		maxDelay:    maxDelay,
+		maxAttempts: maxAttempts,
+	}, nil
+}
+
+// wait returns the time to wait before the given attempt, starting at 1,
+// jitter is drawn from r.
+func (b *backoff) wait(attempt int, r *rand.Rand) time.Duration {
+	switch b.policy {
+	case "fixed":
+		return b.delay
+	case "exponential", "jittered":
+		d := b.delay
+		for i := 1; i < attempt && (b.maxDelay == 0 || d < b.maxDelay); i++ {
+			d *= 2
+		}
+		if b.maxDelay > 0 && d > b.maxDelay {
+			d = b.maxDelay
+		}
+		if b.policy == "jittered" && d > 0 {
+			d = time.Duration(r.Int63n(int64(d) + 1))
+		}
+		return d
+	}
+
+	return 0
+}
+
+// reconnectLoop tries to re-establish a dropped connection following the
+// pool backoff policy, until it succeeds, runs out of attempts, the pool is
+// quitting or the connection is removed meanwhile. The connection keeps
+// drawing random values from r.
+func (p *pool) reconnectLoop(index int, r *rand.Rand, disconnected time.Time) {
+	p.Lock()
+	p.reconnecting++
+	p.Unlock()
+
+	for attempt := 1; p.reconnect.maxAttempts == 0 || attempt <= p.reconnect.maxAttempts; attempt++ {
+		timer := time.NewTimer(p.reconnect.wait(attempt, r))
+		select {
+		case <-p.quitting:
+			timer.Stop()
+			p.reconnected()
+			return
+		case <-timer.C:
+		}
+
+		if p.abandon() {
+			return
+		}
+
+		wsReconnectAttempts.Inc()
+		if err := p.connect(index, r); err == nil {
+			d := time.Since(disconnected)
+			p.reconnects.Record(d)
+			wsReconnects.Inc()
+			wsReconnectDuration.Observe(d.Seconds())
+			p.reconnected()
+			return
+		}
+	}
+
+	log.Printf("Giving up reconnecting connection %d after %d attempts\n", index, p.reconnect.maxAttempts)
+	wsReconnectsAbandoned.Inc()
+	p.reconnected()
+}
+
+// abandon reports whether a reconnection should be given up because the
+// connection was removed from the pool meanwhile.
+func (p *pool) abandon() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.abandoned == 0 {
+		return false
+	}
+
+	p.abandoned--
+	p.reconnecting--
+	return true
+}
+
+// reconnected stops accounting a connection as reconnecting.
+func (p *pool) reconnected() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.reconnecting--
+	if p.abandoned > p.reconnecting {
+		p.abandoned = p.reconnecting
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// runConfig is the configuration a run was started with.
+type runConfig struct {
+	Targets        []string `json:"targets"`
+	Scenario       string   `json:"scenario,omitempty"`
+	Origin         string   `json:"origin,omitempty"`
+	Proxy          string   `json:"proxy,omitempty"`
+	Subprotocols   []string `json:"subprotocols,omitempty"`
+	LocalAddresses []string `json:"local_addresses,omitempty"`
+	Seed           int64    `json:"seed"`
+	Feeder         string   `json:"feeder,omitempty"`
+	FeederMode     string   `json:"feeder_mode,omitempty"`
+	Connections    int      `json:"connections"`
+	Concurrency    int      `json:"concurrency"`
+	Rate           float64  `json:"rate,omitempty"`
+	MaxInFlight    int      `json:"max_in_flight,omitempty"`
+	ArrivalProcess string   `json:"arrival_process,omitempty"`
+	Stages         string   `json:"stages,omitempty"`
+	SendSchedule   string   `json:"send_schedule,omitempty"`
+	PayloadType    string   `json:"payload_type,omitempty"`
+	MeasureLatency bool     `json:"measure_latency"`
+	ReadLimit      int64    `json:"read_limit"`
+	Reconnect      string   `json:"reconnect,omitempty"`
+
+	ConnectTimeout time.Duration `json:"connect_timeout"`
+	TLSTimeout     time.Duration `json:"tls_timeout"`
+	UpgradeTimeout time.Duration `json:"upgrade_timeout"`
+	ConnectRetries int           `json:"connect_retries"`
+}
+
+// connectionReport summarizes the connection attempts of a run.
+type connectionReport struct {
+	Attempted   int64            `json:"attempted"`
+	Established int64            `json:"established"`
+	Failed      int64            `json:"failed"`
+	Closed      int64            `json:"closed"`
+	Errors      map[string]int64 `json:"errors"`
+	Retries     int64            `json:"retries"`
+	OnRetry     int64            `json:"established_on_retry"`
+	Dropped     int64            `json:"dropped"`
+	DropErrors  map[string]int64 `json:"drop_errors"`
+
+	ReconnectAttempts   int64 `json:"reconnect_attempts"`
+	Reconnects          int64 `json:"reconnects"`
+	ReconnectsAbandoned int64 `json:"reconnects_abandoned"`
+
+	ScriptsCompleted int64 `json:"scripts_completed"`
+	ScriptsFailed    int64 `json:"scripts_failed"`
+}
+
+// messageReport summarizes the traffic of a run.
+type messageReport struct {
+	Sent              int64   `json:"sent"`
+	Received          int64   `json:"received"`
+	BytesSent         int64   `json:"bytes_sent"`
+	BytesReceived     int64   `json:"bytes_received"`
+	SentPerSecond     float64 `json:"sent_per_second"`
+	ReceivedPerSecond float64 `json:"received_per_second"`
+}
+
+// tlsReport summarizes the TLS handshakes of a run.
+type tlsReport struct {
+	Handshakes     int64                  `json:"handshakes"`
+	Resumed        int64                  `json:"resumed"`
+	ResumptionRate float64                `json:"resumption_rate"`
+	Handshake      util.HistogramSnapshot `json:"handshake"`
+}
+
+// report is the summary of a benchmarker run. Durations are expressed in
+// nanoseconds when encoded as JSON.
+type report struct {
+	Config      runConfig               `json:"config"`
+	Start       time.Time               `json:"start"`
+	End         time.Time               `json:"end"`
+	Duration    time.Duration           `json:"duration"`
+	StopReason  string                  `json:"stop_reason"`
+	Connections connectionReport        `json:"connections"`
+	Messages    messageReport           `json:"messages"`
+	Dial        util.HistogramSnapshot  `json:"dial"`
+	DNS         *util.HistogramSnapshot `json:"dns,omitempty"`
+	TCP         util.HistogramSnapshot  `json:"tcp"`
+	Proxy       *util.HistogramSnapshot `json:"proxy,omitempty"`
+	TLS         *tlsReport              `json:"tls,omitempty"`
+	Upgrade     util.HistogramSnapshot  `json:"upgrade"`
+	Reconnect   *util.HistogramSnapshot `json:"reconnect,omitempty"`
+	Arrivals    *arrivalStats           `json:"arrivals,omitempty"`
+	RoundTrip   *latencyStats           `json:"round_trip,omitempty"`
+	Thresholds  []thresholdResult       `json:"thresholds,omitempty"`
+}
+
+// newReport builds the report of a run from the registered metrics and the
+// pool statistics.
+func newReport(cfg runConfig, p *pool, start, end time.Time) (*report, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+
+	r := &report{
+		Config:   cfg,
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start),
+		Connections: connectionReport{
+			Attempted:   counterValue(byName["ws_connections_attempted"]),
+			Established: counterValue(byName["ws_connections_established"]),
+			Failed:      counterValue(byName["ws_connections_failed"]),
+			Closed:      counterValue(byName["ws_connections_closed"]),
+			Errors:      counterValues(byName["ws_connections_failed"], "class"),
+			Retries:     counterValue(byName["ws_connect_retries"]),
+			OnRetry:     counterValue(byName["ws_connections_established_on_retry"]),
+			Dropped:     counterValue(byName["ws_connections_dropped"]),
+			DropErrors:  counterValues(byName["ws_connections_dropped"], "class"),
+
+			ReconnectAttempts:   counterValue(byName["ws_reconnect_attempts"]),
+			Reconnects:          counterValue(byName["ws_reconnects"]),
+			ReconnectsAbandoned: counterValue(byName["ws_reconnects_abandoned"]),
+
+			ScriptsCompleted: counterValue(byName["ws_scripts_completed"]),
+			ScriptsFailed:    counterValue(byName["ws_scripts_failed"]),
+		},
+		Messages: messageReport{
+			Sent:          counterValue(byName["ws_messages_sent"]),
+			Received:      counterValue(byName["ws_messages_received"]),
+			BytesSent:     counterValue(byName["ws_bytes_sent"]),
+			BytesReceived: counterValue(byName["ws_bytes_received"]),
+		},
+		Dial:    p.dials.Snapshot(),
+		TCP:     p.tcpConnects.Snapshot(),
+		Upgrade: p.upgrades.Snapshot(),
+	}
+
+	if seconds := r.Duration.Seconds(); seconds > 0 {
+		r.Messages.SentPerSecond = float64(r.Messages.Sent) / seconds
+		r.Messages.ReceivedPerSecond = float64(r.Messages.Received) / seconds
+	}
+	if s := p.dnsLookups.Snapshot(); s.Count > 0 {
+		r.DNS = &s
+	}
+	if s := p.proxyConnects.Snapshot(); s.Count > 0 {
+		r.Proxy = &s
+	}
+	if handshakes := counterValue(byName["ws_tls_handshakes"]); handshakes > 0 {
+		r.TLS = &tlsReport{
+			Handshakes:     handshakes,
+			Resumed:        counterValue(byName["ws_tls_resumed"]),
+			ResumptionRate: float64(counterValue(byName["ws_tls_resumed"])) / float64(handshakes),
+			Handshake:      p.tlsHandshakes.Snapshot(),
+		}
+	}
+	if p.reconnect != nil {
+		s := p.reconnects.Snapshot()
+		r.Reconnect = &s
+	}
+	if p.arrivals != nil {
+		s := p.arrivals.stats()
+		r.Arrivals = &s
+	}
+	if p.latency != nil {
+		s := p.latency.stats()
+		r.RoundTrip = &s
+	}
+
+	return r, nil
+}
+
+// counterValue returns the sum of every counter in a metric family.
+func counterValue(mf *dto.MetricFamily) int64 {
+	var v float64
+	for _, m := range mf.GetMetric() {
+		v += m.GetCounter().GetValue()
+	}
+	return int64(v)
+}
+
+// counterValues returns the counters of a metric family keyed by the value of
+// the given label.
+func counterValues(mf *dto.MetricFamily, label string) map[string]int64 {
+	values := make(map[string]int64)
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == label {
+				values[lp.GetValue()] += int64(m.GetCounter().GetValue())
+			}
+		}
+	}
+	return values
+}
+
+// print writes the report as a human readable table.
+func (r *report) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	for _, target := range r.Config.Targets {
+		fmt.Fprintf(tw, "Target\t%s\n", target)
+	}
+	fmt.Fprintf(tw, "Duration\t%v (%s)\n", r.Duration, r.StopReason)
+	fmt.Fprintf(tw, "Concurrency\t%d\n", r.Config.Concurrency)
+	fmt.Fprintf(tw, "Seed\t%d\n", r.Config.Seed)
+	if r.Config.Stages != "" {
+		fmt.Fprintf(tw, "Stages\t%s\n", r.Config.Stages)
+	}
+	if r.Config.SendSchedule != "" {
+		fmt.Fprintf(tw, "Send schedule\t%s\n", r.Config.SendSchedule)
+	}
+	fmt.Fprintf(tw, "\t\n")
+
+	c := r.Connections
+	fmt.Fprintf(tw, "Connections\tattempted\testablished\tfailed\tclosed\n")
+	fmt.Fprintf(tw, "\t%d\t%d\t%d\t%d\n", c.Attempted, c.Established, c.Failed, c.Closed)
+	if r.Config.ConnectRetries > 0 {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Retries\tattempts\testablished\n")
+		fmt.Fprintf(tw, "\t%d\t%d\n", c.Retries, c.OnRetry)
+	}
+	if r.Reconnect != nil {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Reconnects\tattempts\treconnected\tabandoned\n")
+		fmt.Fprintf(tw, "\t%d\t%d\t%d\n", c.ReconnectAttempts, c.Reconnects, c.ReconnectsAbandoned)
+	}
+	if c.ScriptsCompleted > 0 || c.ScriptsFailed > 0 {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Scripts\tcompleted\tfailed\n")
+		fmt.Fprintf(tw, "\t%d\t%d\n", c.ScriptsCompleted, c.ScriptsFailed)
+	}
+	printClasses(tw, "Errors", c.Errors)
+	printClasses(tw, "Dropped", c.DropErrors)
+	fmt.Fprintf(tw, "\t\n")
+
+	m := r.Messages
+	fmt.Fprintf(tw, "Messages\tsent\treceived\tbytes sent\tbytes received\n")
+	fmt.Fprintf(tw, "\t%d\t%d\t%d\t%d\n", m.Sent, m.Received, m.BytesSent, m.BytesReceived)
+	fmt.Fprintf(tw, "\t%.2f/s\t%.2f/s\t\t\n", m.SentPerSecond, m.ReceivedPerSecond)
+	fmt.Fprintf(tw, "\t\n")
+
+	fmt.Fprintf(tw, "Latency\tcount\tp50\tp90\tp99\tp99.9\tmax\n")
+	printHistogram(tw, "dial", r.Dial)
+	if r.DNS != nil {
+		printHistogram(tw, "dns", *r.DNS)
+	}
+	printHistogram(tw, "tcp", r.TCP)
+	if r.Proxy != nil {
+		printHistogram(tw, "proxy", *r.Proxy)
+	}
+	if r.TLS != nil {
+		printHistogram(tw, "tls", r.TLS.Handshake)
+	}
+	printHistogram(tw, "upgrade", r.Upgrade)
+	if r.Reconnect != nil {
+		printHistogram(tw, "reconnect", *r.Reconnect)
+	}
+	if r.RoundTrip != nil {
+		printHistogram(tw, "round trip", r.RoundTrip.HistogramSnapshot)
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Unanswered\t%d\n", r.RoundTrip.Unanswered)
+	}
+
+	if t := r.TLS; t != nil {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "TLS\thandshakes\tresumed\tresumption rate\n")
+		fmt.Fprintf(tw, "\t%d\t%d\t%.2f%%\n", t.Handshakes, t.Resumed, t.ResumptionRate*100)
+	}
+
+	if a := r.Arrivals; a != nil {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Arrivals\ttarget\tachieved\tmean lag\tmax lag\n")
+		fmt.Fprintf(tw, "\t%.2f/s\t%.2f/s\t%v\t%v\n", a.TargetRate, a.AchievedRate, a.MeanLag, a.MaxLag)
+	}
+
+	if len(r.Thresholds) > 0 {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Thresholds\tresult\tactual\n")
+		for _, t := range r.Thresholds {
+			result, actual := "pass", strconv.FormatFloat(t.Actual, 'g', -1, 64)
+			if !t.Passed {
+				result = "FAIL"
+			}
+			if !t.Available {
+				actual = "n/a"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", t.Threshold, result, actual)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func printClasses(w io.Writer, title string, counts map[string]int64) {
+	if len(counts) == 0 {
+		return
+	}
+
+	classes := make([]string, 0, len(counts))
+	for class := range counts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	fmt.Fprintf(w, "\t\n")
+	fmt.Fprintf(w, "%s\tclass\tcount\n", title)
+	for _, class := range classes {
+		fmt.Fprintf(w, "\t%s\t%d\n", class, counts[class])
+	}
+}
+
+func printHistogram(w io.Writer, name string, s util.HistogramSnapshot) {
+	fmt.Fprintf(w, "  %s\t%d\t%v\t%v\t%v\t%v\t%v\n", name, s.Count, s.P50, s.P90, s.P99, s.P999, s.Max)
+}
+
+// writeJSON writes the report as JSON to the given file.
+func (r *report) writeJSON(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
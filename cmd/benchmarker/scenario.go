@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// duration is a time.Duration read from JSON strings such as "5m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: expected a string such as \"5m\"", b)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// scenario is a declarative description of a benchmarker run. Every field is
+// optional and mirrors a command line flag, flags explicitly set on the
+// command line take precedence.
+type scenario struct {
+	Targets        []string           `json:"targets"`
+	Origin         *string            `json:"origin"`
+	Headers        map[string]string  `json:"headers"`
+	Cookies        map[string]string  `json:"cookies"`
+	Subprotocols   []string           `json:"subprotocols"`
+	Proxy          *string            `json:"proxy"`
+	LocalAddresses []string           `json:"local_addresses"`
+	Timeouts       *scenarioTimeouts  `json:"timeouts"`
+	Retries        *scenarioRetries   `json:"retries"`
+	BearerToken    *string            `json:"bearer_token"`
+	Feeder         *scenarioFeeder    `json:"feeder"`
+	Seed           *int64             `json:"seed"`
+	TLS            *scenarioTLS       `json:"tls"`
+	Connections    *int               `json:"connections"`
+	Concurrency    *int               `json:"concurrency"`
+	Rate           *float64           `json:"rate"`
+	MaxInFlight    *int               `json:"max_in_flight"`
+	ArrivalProcess *string            `json:"arrival_process"`
+	Stages         []scenarioStage    `json:"stages"`
+	Send           *scenarioSend      `json:"send"`
+	Script         []scriptStep       `json:"script"`
+	Reconnect      *scenarioReconnect `json:"reconnect"`
+	Duration       *duration          `json:"duration"`
+	MaxMessages    *int64             `json:"max_messages"`
+	Thresholds     []string           `json:"thresholds"`
+}
+
+// scenarioStage mirrors a --stages entry.
+type scenarioStage struct {
+	Duration duration `json:"duration"`
+	Target   int      `json:"target"`
+}
+
+// scenarioFeeder mirrors the template data feeder flags.
+type scenarioFeeder struct {
+	File *string `json:"file"`
+	Mode *string `json:"mode"`
+}
+
+// scenarioTimeouts mirrors the dial timeout flags.
+type scenarioTimeouts struct {
+	Connect *duration `json:"connect"`
+	TLS     *duration `json:"tls"`
+	Upgrade *duration `json:"upgrade"`
+}
+
+// scenarioRetries mirrors the connect retry flags.
+type scenarioRetries struct {
+	Count *int      `json:"count"`
+	Delay *duration `json:"delay"`
+}
+
+// scenarioTLS mirrors the TLS flags.
+type scenarioTLS struct {
+	CAFile             *string  `json:"ca_file"`
+	CertFile           *string  `json:"cert_file"`
+	KeyFile            *string  `json:"key_file"`
+	InsecureSkipVerify *bool    `json:"insecure_skip_verify"`
+	ServerName         *string  `json:"server_name"`
+	MinVersion         *string  `json:"min_version"`
+	MaxVersion         *string  `json:"max_version"`
+	Ciphers            []string `json:"ciphers"`
+	SessionCache       *int     `json:"session_cache"`
+}
+
+// scenarioSend mirrors the message workload flags.
+type scenarioSend struct {
+	Schedule       *string `json:"schedule"`
+	Payload        *string `json:"payload"`
+	PayloadType    *string `json:"payload_type"`
+	MeasureLatency *bool   `json:"measure_latency"`
+	ReadLimit      *int64  `json:"read_limit"`
+}
+
+// scenarioReconnect mirrors the reconnection flags.
+type scenarioReconnect struct {
+	Policy      *string   `json:"policy"`
+	Delay       *duration `json:"delay"`
+	MaxDelay    *duration `json:"max_delay"`
+	MaxAttempts *int      `json:"max_attempts"`
+}
+
+// loadScenario reads a scenario from a JSON file, or a YAML one if named
+// *.yaml or *.yml.
+func loadScenario(path string) (*scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, fmt.Errorf("invalid scenario %s: %v", path, err)
+		}
+	}
+
+	sc := &scenario{}
+	if err := json.Unmarshal(b, sc); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %v", path, err)
+	}
+
+	return sc, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so scenarios in both formats
+// are decoded the same way.
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue turns the maps decoded from YAML, keyed by any type, into maps
+// keyed by strings as encoding/json expects.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// apply sets the flags described by the scenario, leaving alone the ones
+// explicitly set on the command line.
+func (sc *scenario) apply(fs *pflag.FlagSet) error {
+	values := make(map[string][]string)
+	set := func(name string, value ...string) {
+		values[name] = value
+	}
+
+	if sc.Origin != nil {
+		set("origin", *sc.Origin)
+	}
+	if len(sc.Headers) > 0 {
+		var headers []string
+		for name, value := range sc.Headers {
+			headers = append(headers, name+": "+value)
+		}
+		set("header", headers...)
+	}
+	if len(sc.Cookies) > 0 {
+		var cookies []string
+		for name, value := range sc.Cookies {
+			cookies = append(cookies, name+"="+value)
+		}
+		set("cookie", cookies...)
+	}
+	if len(sc.Subprotocols) > 0 {
+		set("subprotocol", sc.Subprotocols...)
+	}
+	if sc.Proxy != nil {
+		set("proxy", *sc.Proxy)
+	}
+	if len(sc.LocalAddresses) > 0 {
+		set("local-address", sc.LocalAddresses...)
+	}
+	if sc.BearerToken != nil {
+		set("bearer-token", *sc.BearerToken)
+	}
+	if f := sc.Feeder; f != nil {
+		if f.File != nil {
+			set("feeder", *f.File)
+		}
+		if f.Mode != nil {
+			set("feeder-mode", *f.Mode)
+		}
+	}
+	if sc.Seed != nil {
+		set("seed", strconv.FormatInt(*sc.Seed, 10))
+	}
+	if t := sc.Timeouts; t != nil {
+		if t.Connect != nil {
+			set("connect-timeout", t.Connect.String())
+		}
+		if t.TLS != nil {
+			set("tls-timeout", t.TLS.String())
+		}
+		if t.Upgrade != nil {
+			set("upgrade-timeout", t.Upgrade.String())
+		}
+	}
+	if r := sc.Retries; r != nil {
+		if r.Count != nil {
+			set("connect-retries", strconv.Itoa(*r.Count))
+		}
+		if r.Delay != nil {
+			set("connect-retry-delay", r.Delay.String())
+		}
+	}
+	if t := sc.TLS; t != nil {
+		if t.CAFile != nil {
+			set("tls-ca-file", *t.CAFile)
+		}
+		if t.CertFile != nil {
+			set("tls-cert-file", *t.CertFile)
+		}
+		if t.KeyFile != nil {
+			set("tls-key-file", *t.KeyFile)
+		}
+		if t.InsecureSkipVerify != nil {
+			set("tls-insecure-skip-verify", strconv.FormatBool(*t.InsecureSkipVerify))
+		}
+		if t.ServerName != nil {
+			set("tls-server-name", *t.ServerName)
+		}
+		if t.MinVersion != nil {
+			set("tls-min-version", *t.MinVersion)
+		}
+		if t.MaxVersion != nil {
+			set("tls-max-version", *t.MaxVersion)
+		}
+		if len(t.Ciphers) > 0 {
+			set("tls-ciphers", strings.Join(t.Ciphers, ","))
+		}
+		if t.SessionCache != nil {
+			set("tls-session-cache", strconv.Itoa(*t.SessionCache))
+		}
+	}
+	if sc.Connections != nil {
+		set("connections", strconv.Itoa(*sc.Connections))
+	}
+	if sc.Concurrency != nil {
+		set("concurrency", strconv.Itoa(*sc.Concurrency))
+	}
+	if sc.Rate != nil {
+		set("rate", strconv.FormatFloat(*sc.Rate, 'g', -1, 64))
+	}
+	if sc.MaxInFlight != nil {
+		set("max-in-flight", strconv.Itoa(*sc.MaxInFlight))
+	}
+	if sc.ArrivalProcess != nil {
+		set("arrival-process", *sc.ArrivalProcess)
+	}
+	if len(sc.Stages) > 0 {
+		var stages []string
+		for _, s := range sc.Stages {
+			stages = append(stages, fmt.Sprintf("%v:%d", s.Duration, s.Target))
+		}
+		set("stages", strings.Join(stages, ","))
+	}
+	if s := sc.Send; s != nil {
+		if s.Schedule != nil {
+			set("send-schedule", *s.Schedule)
+		}
+		if s.Payload != nil {
+			set("payload", *s.Payload)
+		}
+		if s.PayloadType != nil {
+			set("payload-type", *s.PayloadType)
+		}
+		if s.MeasureLatency != nil {
+			set("measure-latency", strconv.FormatBool(*s.MeasureLatency))
+		}
+		if s.ReadLimit != nil {
+			set("read-limit", strconv.FormatInt(*s.ReadLimit, 10))
+		}
+	}
+	if r := sc.Reconnect; r != nil {
+		if r.Policy != nil {
+			set("reconnect", *r.Policy)
+		}
+		if r.Delay != nil {
+			set("reconnect-delay", r.Delay.String())
+		}
+		if r.MaxDelay != nil {
+			set("reconnect-max-delay", r.MaxDelay.String())
+		}
+		if r.MaxAttempts != nil {
+			set("reconnect-max-attempts", strconv.Itoa(*r.MaxAttempts))
+		}
+	}
+	if sc.Duration != nil {
+		set("duration", sc.Duration.String())
+	}
+	if sc.MaxMessages != nil {
+		set("max-messages", strconv.FormatInt(*sc.MaxMessages, 10))
+	}
+	if len(sc.Thresholds) > 0 {
+		set("threshold", sc.Thresholds...)
+	}
+
+	for name, vs := range values {
+		if fs.Changed(name) {
+			continue
+		}
+		for _, v := range vs {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid scenario %s: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"time"
+)
+
+const (
+	// Time allowed for an expected reply when the step sets no timeout.
+	defaultExpectTimeout = 10 * time.Second
+)
+
+var (
+	errExpectTimeout = errors.New("expected reply not received in time")
+)
+
+// scriptStep is a step of the script every connection runs once established,
+// exactly one of Send, Expect or Sleep must be set. Send payloads are
+// templates rendered with the connection template data, Expect is a regular
+// expression a received message must match within Timeout, if set.
+type scriptStep struct {
+	Send    *string   `json:"send"`
+	Expect  *string   `json:"expect"`
+	Timeout *duration `json:"timeout"`
+	Sleep   *duration `json:"sleep"`
+}
+
+// scriptAction is a compiled script step.
+type scriptAction struct {
+	payload *compiledTemplate
+	expect  *regexp.Regexp
+	wait    time.Duration
+	sleep   bool
+}
+
+// compileScript validates the script steps and compiles their expectations.
+func compileScript(steps []scriptStep) ([]scriptAction, error) {
+	actions := make([]scriptAction, 0, len(steps))
+	for i, step := range steps {
+		set := 0
+		var a scriptAction
+		if step.Send != nil {
+			set++
+			t, err := compileTemplate(*step.Send)
+			if err != nil {
+				return nil, fmt.Errorf("invalid script step %d: %v", i+1, err)
+			}
+			a.payload = t
+		}
+		if step.Expect != nil {
+			set++
+			re, err := regexp.Compile(*step.Expect)
+			if err != nil {
+				return nil, fmt.Errorf("invalid script step %d: %v", i+1, err)
+			}
+			a.expect = re
+			a.wait = defaultExpectTimeout
+			if step.Timeout != nil {
+				a.wait = time.Duration(*step.Timeout)
+			}
+		}
+		if step.Sleep != nil {
+			set++
+			a.sleep = true
+			a.wait = time.Duration(*step.Sleep)
+		}
+
+		if set != 1 {
+			return nil, fmt.Errorf("invalid script step %d: exactly one of send, expect or sleep must be set", i+1)
+		}
+		if step.Timeout != nil && step.Expect == nil {
+			return nil, fmt.Errorf("invalid script step %d: timeout only applies to expect", i+1)
+		}
+		if step.Timeout != nil && *step.Timeout < 0 {
+			return nil, fmt.Errorf("invalid script step %d: timeout %v must not be negative", i+1, *step.Timeout)
+		}
+		if step.Sleep != nil && *step.Sleep < 0 {
+			return nil, fmt.Errorf("invalid script step %d: sleep %v must not be negative", i+1, *step.Sleep)
+		}
+		actions = append(actions, a)
+	}
+
+	return actions, nil
+}
+
+// scriptRun is the execution of a script by a connection. It is not safe for
+// concurrent use.
+type scriptRun struct {
+	actions []scriptAction
+	pos     int
+	timer   *time.Timer
+
+	// Expectation waiting for a matching message, nil when sleeping.
+	expecting *regexp.Regexp
+}
+
+// newScriptRun prepares the execution of a compiled script, binding its
+// payloads to the connection random source r.
+func newScriptRun(actions []scriptAction, r *rand.Rand) *scriptRun {
+	bound := make([]scriptAction, len(actions))
+	for i, a := range actions {
+		if a.payload != nil {
+			a.payload = a.payload.bind(r)
+		}
+		bound[i] = a
+	}
+	return &scriptRun{actions: bound}
+}
+
+// C returns a channel firing when the current sleep or expectation times
+// out, nil if nothing is pending.
+func (r *scriptRun) C() <-chan time.Time {
+	if r.timer == nil {
+		return nil
+	}
+	return r.timer.C
+}
+
+// done reports whether every step has been executed.
+func (r *scriptRun) done() bool {
+	return r.pos >= len(r.actions) && r.timer == nil
+}
+
+// advance executes steps until one has to wait for time to pass or for a
+// message to arrive. Sends go through the pool like workload messages, those
+// past the message limit are skipped as the run is stopping anyway.
+func (r *scriptRun) advance(p *pool, c *connection) error {
+	for r.pos < len(r.actions) {
+		a := r.actions[r.pos]
+		r.pos++
+
+		if a.expect == nil && !a.sleep {
+			c.data.nextMessage()
+			data, err := a.payload.render(c.data)
+			if err != nil {
+				return err
+			}
+			if err := p.sendMessage(c, data); err != nil && err != errMessageLimit {
+				return err
+			}
+			continue
+		}
+
+		r.expecting = a.expect
+		r.timer = time.NewTimer(a.wait)
+		return nil
+	}
+
+	return nil
+}
+
+// received checks a message against the pending expectation and moves on to
+// the next steps if it matches.
+func (r *scriptRun) received(p *pool, c *connection, data []byte) error {
+	if r.expecting == nil || !r.expecting.Match(data) {
+		return nil
+	}
+
+	r.stop()
+	return r.advance(p, c)
+}
+
+// fired handles the pending timer firing: sleeps move on to the next steps
+// while expectations fail.
+func (r *scriptRun) fired(p *pool, c *connection) error {
+	expecting := r.expecting
+	r.timer, r.expecting = nil, nil
+	if expecting != nil {
+		return fmt.Errorf("%v: %s", errExpectTimeout, expecting)
+	}
+
+	return r.advance(p, c)
+}
+
+// stop cancels any pending sleep or expectation.
+func (r *scriptRun) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer, r.expecting = nil, nil
+}
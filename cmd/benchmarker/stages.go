@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often the number of connections is adjusted while ramping.
+	rampInterval = 100 * time.Millisecond
+)
+
+// stage is a step of a load profile: the number of connections is linearly
+// moved towards target during duration.
+type stage struct {
+	duration time.Duration
+	target   int
+}
+
+// parseStages parses a comma separated list of duration:target pairs, e.g.
+// "5m:10000,20m:10000,2m:0".
+func parseStages(s string) ([]stage, error) {
+	var stages []stage
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		parts := strings.SplitN(raw, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stage %q: expected duration:target", raw)
+		}
+
+		duration, err := time.ParseDuration(parts[0])
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid stage %q: bad duration", raw)
+		}
+
+		target, err := strconv.Atoi(parts[1])
+		if err != nil || target < 0 {
+			return nil, fmt.Errorf("invalid stage %q: bad target", raw)
+		}
+
+		stages = append(stages, stage{duration, target})
+	}
+
+	return stages, nil
+}
+
+// runStages executes the given stages one after another, blocking until all
+// of them are completed or the pool is quitting.
+func (p *pool) runStages(stages []stage) {
+	current := p.size()
+	for i, s := range stages {
+		log.Printf("Stage %d/%d started: %d connections over %v\n", i+1, len(stages), s.target, s.duration)
+		if !p.ramp(current, s) {
+			return
+		}
+		current = s.target
+	}
+	log.Println("Stages completed")
+}
+
+// ramp moves the number of connections from start to the stage target. It
+// only adds or removes the difference between consecutive steps, so
+// connections dropped by the peer in the meantime are not replaced.
+func (p *pool) ramp(start int, s stage) bool {
+	ticker := time.NewTicker(rampInterval)
+	defer ticker.Stop()
+
+	begin := time.Now()
+	applied := start
+	for {
+		elapsed := time.Since(begin)
+
+		want := s.target
+		if elapsed < s.duration {
+			want = start + int(float64(s.target-start)*float64(elapsed)/float64(s.duration))
+		}
+
+		if want > applied {
+			p.add(want - applied)
+		} else if want < applied {
+			p.remove(applied - want)
+		}
+		applied = want
+
+		if elapsed >= s.duration {
+			return true
+		}
+
+		select {
+		case <-p.quitting:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+var (
+	letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+	// Hash functions available to hash and hmac by name.
+	hashes = map[string]func() hash.Hash{
+		"md5":    md5.New,
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+
+	// Named timestamp formats, other formats are taken as Go time layouts.
+	timestampFormats = map[string]func(t time.Time) string{
+		"unix":        func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+		"unixms":      func(t time.Time) string { return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) },
+		"unixns":      func(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) },
+		"rfc3339":     func(t time.Time) string { return t.Format(time.RFC3339) },
+		"rfc3339nano": func(t time.Time) string { return t.Format(time.RFC3339Nano) },
+		"http":        func(t time.Time) string { return t.UTC().Format(http.TimeFormat) },
+	}
+
+	// Functions available to URL, header and payload templates, along with
+	// the random ones (see randomFuncs).
+	tmplFuncs = template.FuncMap{
+		"now": time.Now,
+		"timestamp": func(format string) string {
+			if f, ok := timestampFormats[format]; ok {
+				return f(time.Now())
+			}
+			return time.Now().Format(format)
+		},
+		"env": func(name string, fallback ...string) string {
+			if v, ok := os.LookupEnv(name); ok {
+				return v
+			}
+			return strings.Join(fallback, "")
+		},
+		"base64": func(v interface{}) string {
+			return base64.StdEncoding.EncodeToString(tmplBytes(v))
+		},
+		"base64url": func(v interface{}) string {
+			return base64.RawURLEncoding.EncodeToString(tmplBytes(v))
+		},
+		"base64decode": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+		"hex": func(v interface{}) string {
+			return hex.EncodeToString(tmplBytes(v))
+		},
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"hash": func(algorithm string, v interface{}) (digest, error) {
+			h, ok := hashes[algorithm]
+			if !ok {
+				return nil, fmt.Errorf("hash: unknown algorithm %q", algorithm)
+			}
+			d := h()
+			d.Write(tmplBytes(v))
+			return digest(d.Sum(nil)), nil
+		},
+		"hmac": func(algorithm string, key, v interface{}) (digest, error) {
+			h, ok := hashes[algorithm]
+			if !ok {
+				return nil, fmt.Errorf("hmac: unknown algorithm %q", algorithm)
+			}
+			mac := hmac.New(h, tmplBytes(key))
+			mac.Write(tmplBytes(v))
+			return digest(mac.Sum(nil)), nil
+		},
+	}
+)
+
+func init() {
+	for name, f := range randomFuncs(globalRand{}) {
+		tmplFuncs[name] = f
+	}
+}
+
+// randomSource is where random template functions draw values from.
+type randomSource interface {
+	Intn(n int) int
+	Float64() float64
+}
+
+// globalRand draws from the global math/rand source, it only backs templates
+// not bound to a connection.
+type globalRand struct{}
+
+func (globalRand) Intn(n int) int   { return rand.Intn(n) }
+func (globalRand) Float64() float64 { return rand.Float64() }
+
+// randomFuncs returns the random template functions drawing from r.
+// Connections bind them to their own source (see compiledTemplate.bind) so
+// runs with the same --seed render the same values.
+func randomFuncs(r randomSource) template.FuncMap {
+	return template.FuncMap{
+		"randomString": func(n int) string {
+			b := make([]rune, n)
+			for i := range b {
+				b[i] = letterRunes[r.Intn(len(letterRunes))]
+			}
+			return string(b)
+		},
+		"randomInt": func(min, max int) (int, error) {
+			if max < min {
+				return 0, fmt.Errorf("randomInt: max %d below min %d", max, min)
+			}
+			return min + r.Intn(max-min+1), nil
+		},
+		"randomFloat": func(min, max float64) (float64, error) {
+			if max < min {
+				return 0, fmt.Errorf("randomFloat: max %g below min %g", max, min)
+			}
+			return min + r.Float64()*(max-min), nil
+		},
+		"randomChoice": func(items ...interface{}) (interface{}, error) {
+			if len(items) == 0 {
+				return nil, fmt.Errorf("randomChoice: no items")
+			}
+			return items[r.Intn(len(items))], nil
+		},
+		"uuid": func() string {
+			var b [16]byte
+			for i := range b {
+				b[i] = byte(r.Intn(256))
+			}
+			b[6] = b[6]&0x0f | 0x40
+			b[8] = b[8]&0x3f | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		},
+	}
+}
+
+// digest is a hash sum, it prints as hex while base64 and hex encode its raw
+// bytes.
+type digest []byte
+
+func (d digest) String() string {
+	return hex.EncodeToString(d)
+}
+
+// tmplBytes returns the bytes template encoding functions operate on.
+func tmplBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case digest:
+		return v
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// compiledTemplate is a template parsed once per run. Static templates, the
+// ones without actions, are rendered without being executed.
+type compiledTemplate struct {
+	raw  string
+	tmpl *template.Template
+
+	// Rendered text of static templates, shared by every render so it must
+	// not be modified.
+	text []byte
+}
+
+// compileTemplate parses a URL, header or payload template.
+func compileTemplate(s string) (*compiledTemplate, error) {
+	tmpl, err := template.New("").Funcs(tmplFuncs).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &compiledTemplate{raw: s, tmpl: tmpl}
+	if text, ok := staticText(tmpl); ok {
+		t.text = text
+	}
+	return t, nil
+}
+
+// staticText returns the text of a parsed template made of plain text only,
+// comments aside.
+func staticText(tmpl *template.Template) ([]byte, bool) {
+	text := []byte{}
+	if tmpl.Tree == nil || tmpl.Root == nil {
+		return text, true
+	}
+	for _, n := range tmpl.Root.Nodes {
+		t, ok := n.(*parse.TextNode)
+		if !ok {
+			return nil, false
+		}
+		text = append(text, t.Text...)
+	}
+	return text, true
+}
+
+// static reports whether the template renders to the same text every time.
+func (t *compiledTemplate) static() bool {
+	return t.text != nil
+}
+
+// bind returns a copy of the template whose random functions draw from r,
+// static templates are returned as is.
+func (t *compiledTemplate) bind(r *rand.Rand) *compiledTemplate {
+	if t.static() {
+		return t
+	}
+
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		panic(err)
+	}
+	return &compiledTemplate{raw: t.raw, tmpl: tmpl.Funcs(randomFuncs(r))}
+}
+
+// render executes the template with the given data.
+func (t *compiledTemplate) render(data interface{}) ([]byte, error) {
+	if t.static() {
+		return t.text, nil
+	}
+
+	b := &bytes.Buffer{}
+	if err := t.tmpl.Execute(b, data); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (t *compiledTemplate) String() string {
+	return t.raw
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+)
+
+// thresholdMetric extracts a value from a report, it returns false if the
+// value is not available in the run (e.g. round trips were not measured).
+type thresholdMetric func(r *report) (float64, bool)
+
+var (
+	// Comparison operators, longest first so "<=" is not taken for "<".
+	thresholdOps = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+	thresholdMetrics = map[string]thresholdMetric{
+		"connections_attempted": func(r *report) (float64, bool) {
+			return float64(r.Connections.Attempted), true
+		},
+		"connections_established": func(r *report) (float64, bool) {
+			return float64(r.Connections.Established), true
+		},
+		"connections_failed": func(r *report) (float64, bool) {
+			return float64(r.Connections.Failed), true
+		},
+		"connect_retries": func(r *report) (float64, bool) {
+			return float64(r.Connections.Retries), true
+		},
+		"connections_dropped": func(r *report) (float64, bool) {
+			return float64(r.Connections.Dropped), true
+		},
+		"connections_closed": func(r *report) (float64, bool) {
+			return float64(r.Connections.Closed), true
+		},
+		"connect_error_rate": func(r *report) (float64, bool) {
+			if r.Connections.Attempted == 0 {
+				return 0, false
+			}
+			return float64(r.Connections.Failed) / float64(r.Connections.Attempted), true
+		},
+		"tls_resumption_rate": func(r *report) (float64, bool) {
+			if r.TLS == nil {
+				return 0, false
+			}
+			return r.TLS.ResumptionRate, true
+		},
+		"reconnects": func(r *report) (float64, bool) {
+			return float64(r.Connections.Reconnects), r.Reconnect != nil
+		},
+		"reconnects_abandoned": func(r *report) (float64, bool) {
+			return float64(r.Connections.ReconnectsAbandoned), r.Reconnect != nil
+		},
+		"scripts_failed": func(r *report) (float64, bool) {
+			return float64(r.Connections.ScriptsFailed), true
+		},
+		"messages_sent": func(r *report) (float64, bool) {
+			return float64(r.Messages.Sent), true
+		},
+		"messages_received": func(r *report) (float64, bool) {
+			return float64(r.Messages.Received), true
+		},
+		"messages_sent_rate": func(r *report) (float64, bool) {
+			return r.Messages.SentPerSecond, true
+		},
+		"messages_received_rate": func(r *report) (float64, bool) {
+			return r.Messages.ReceivedPerSecond, true
+		},
+		"rtt_unanswered": func(r *report) (float64, bool) {
+			if r.RoundTrip == nil {
+				return 0, false
+			}
+			return float64(r.RoundTrip.Unanswered), true
+		},
+		"arrival_rate": func(r *report) (float64, bool) {
+			if r.Arrivals == nil {
+				return 0, false
+			}
+			return r.Arrivals.AchievedRate, true
+		},
+		"arrival_lag_max": func(r *report) (float64, bool) {
+			if r.Arrivals == nil {
+				return 0, false
+			}
+			return r.Arrivals.MaxLag.Seconds(), true
+		},
+	}
+)
+
+func init() {
+	addHistogramMetrics("dial", func(r *report) (util.HistogramSnapshot, bool) {
+		return r.Dial, r.Dial.Count > 0
+	})
+	addHistogramMetrics("dns", func(r *report) (util.HistogramSnapshot, bool) {
+		if r.DNS == nil {
+			return util.HistogramSnapshot{}, false
+		}
+		return *r.DNS, true
+	})
+	addHistogramMetrics("tcp", func(r *report) (util.HistogramSnapshot, bool) {
+		return r.TCP, r.TCP.Count > 0
+	})
+	addHistogramMetrics("proxy", func(r *report) (util.HistogramSnapshot, bool) {
+		if r.Proxy == nil {
+			return util.HistogramSnapshot{}, false
+		}
+		return *r.Proxy, true
+	})
+	addHistogramMetrics("tls", func(r *report) (util.HistogramSnapshot, bool) {
+		if r.TLS == nil {
+			return util.HistogramSnapshot{}, false
+		}
+		return r.TLS.Handshake, true
+	})
+	addHistogramMetrics("upgrade", func(r *report) (util.HistogramSnapshot, bool) {
+		return r.Upgrade, r.Upgrade.Count > 0
+	})
+	addHistogramMetrics("reconnect", func(r *report) (util.HistogramSnapshot, bool) {
+		if r.Reconnect == nil || r.Reconnect.Count == 0 {
+			return util.HistogramSnapshot{}, false
+		}
+		return *r.Reconnect, true
+	})
+	addHistogramMetrics("rtt", func(r *report) (util.HistogramSnapshot, bool) {
+		if r.RoundTrip == nil || r.RoundTrip.Count == 0 {
+			return util.HistogramSnapshot{}, false
+		}
+		return r.RoundTrip.HistogramSnapshot, true
+	})
+}
+
+// addHistogramMetrics registers the summary values of a histogram, in
+// seconds, as <prefix>_<statistic> threshold metrics.
+func addHistogramMetrics(prefix string, get func(r *report) (util.HistogramSnapshot, bool)) {
+	stats := map[string]func(s util.HistogramSnapshot) time.Duration{
+		"min":   func(s util.HistogramSnapshot) time.Duration { return s.Min },
+		"mean":  func(s util.HistogramSnapshot) time.Duration { return s.Mean },
+		"p50":   func(s util.HistogramSnapshot) time.Duration { return s.P50 },
+		"p90":   func(s util.HistogramSnapshot) time.Duration { return s.P90 },
+		"p99":   func(s util.HistogramSnapshot) time.Duration { return s.P99 },
+		"p99_9": func(s util.HistogramSnapshot) time.Duration { return s.P999 },
+		"max":   func(s util.HistogramSnapshot) time.Duration { return s.Max },
+	}
+
+	for name, stat := range stats {
+		stat := stat
+		thresholdMetrics[prefix+"_"+name] = func(r *report) (float64, bool) {
+			s, ok := get(r)
+			if !ok {
+				return 0, false
+			}
+			return stat(s).Seconds(), true
+		}
+	}
+}
+
+// threshold is a pass/fail condition on a report metric, e.g. "p99 RTT below
+// 200ms" is written as "rtt_p99<200ms".
+type threshold struct {
+	raw    string
+	metric string
+	op     string
+	value  float64
+}
+
+// parseThreshold parses a <metric><op><value> condition. Values can be plain
+// numbers, percentages (0.1%) or durations (200ms), which are compared in
+// seconds.
+func parseThreshold(s string) (*threshold, error) {
+	raw := strings.Replace(s, " ", "", -1)
+	for _, op := range thresholdOps {
+		i := strings.Index(raw, op)
+		if i < 0 {
+			continue
+		}
+
+		t := &threshold{raw: s, metric: raw[:i], op: op}
+		if _, ok := thresholdMetrics[t.metric]; !ok {
+			return nil, fmt.Errorf("invalid threshold %q: unknown metric %q (available: %s)", s, t.metric, strings.Join(thresholdMetricNames(), ", "))
+		}
+
+		value, err := parseThresholdValue(raw[i+len(op):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %v", s, err)
+		}
+		t.value = value
+
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("invalid threshold %q: expected <metric><op><value>", s)
+}
+
+func parseThresholdValue(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad percentage %q", s)
+		}
+		return v / 100, nil
+	}
+
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return d.Seconds(), nil
+}
+
+func thresholdMetricNames() []string {
+	names := make([]string, 0, len(thresholdMetrics))
+	for name := range thresholdMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// thresholdResult is the outcome of checking a threshold against a report.
+type thresholdResult struct {
+	Threshold string  `json:"threshold"`
+	Actual    float64 `json:"actual"`
+	Available bool    `json:"available"`
+	Passed    bool    `json:"passed"`
+}
+
+// check evaluates the threshold against a report. Thresholds on metrics not
+// available in the run fail.
+func (t *threshold) check(r *report) thresholdResult {
+	actual, ok := thresholdMetrics[t.metric](r)
+	result := thresholdResult{
+		Threshold: t.raw,
+		Actual:    actual,
+		Available: ok,
+	}
+	if !ok {
+		return result
+	}
+
+	switch t.op {
+	case "<":
+		result.Passed = actual < t.value
+	case "<=":
+		result.Passed = actual <= t.value
+	case ">":
+		result.Passed = actual > t.value
+	case ">=":
+		result.Passed = actual >= t.value
+	case "==":
+		result.Passed = actual == t.value
+	case "!=":
+		result.Passed = actual != t.value
+	}
+
+	return result
+}
+
+// checkThresholds evaluates every threshold against a report, records the
+// results in it and returns whether all of them passed.
+func checkThresholds(thresholds []*threshold, r *report) bool {
+	passed := true
+	r.Thresholds = make([]thresholdResult, 0, len(thresholds))
+	for _, t := range thresholds {
+		result := t.check(r)
+		r.Thresholds = append(r.Thresholds, result)
+		passed = passed && result.Passed
+	}
+	return passed
+}
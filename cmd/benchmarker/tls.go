@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// tlsOptions are the TLS settings used to reach wss:// targets.
+type tlsOptions struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+	serverName         string
+	minVersion         string
+	maxVersion         string
+	ciphers            string
+	sessionCache       int
+}
+
+// newTLSConfig builds the client TLS configuration described by the options.
+func newTLSConfig(o tlsOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.insecureSkipVerify,
+		ServerName:         o.serverName,
+	}
+
+	if o.caFile != "" {
+		pem, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid tls-ca-file %s: no PEM certificates found", o.caFile)
+		}
+	}
+
+	if o.certFile != "" || o.keyFile != "" {
+		if o.certFile == "" || o.keyFile == "" {
+			return nil, fmt.Errorf("invalid client certificate: both tls-cert-file and tls-key-file are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	var err error
+	if cfg.MinVersion, err = parseTLSVersion(o.minVersion); err != nil {
+		return nil, err
+	}
+	if cfg.MaxVersion, err = parseTLSVersion(o.maxVersion); err != nil {
+		return nil, err
+	}
+
+	if o.ciphers != "" {
+		if cfg.CipherSuites, err = parseCipherSuites(o.ciphers); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.sessionCache < 0 {
+		return nil, fmt.Errorf("invalid tls-session-cache %d: must not be negative", o.sessionCache)
+	}
+	if o.sessionCache > 0 {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(o.sessionCache)
+	}
+
+	return cfg, nil
+}
+
+// parseTLSVersion parses a TLS version such as "1.2", empty is the default.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q: expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names as
+// in TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites are not
+// configurable.
+func parseCipherSuites(s string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// minSendDelay is the shortest delay between messages of a connection,
+// shorter random draws are rounded up to it so no schedule makes a connection
+// send in a busy loop.
+const minSendDelay = time.Microsecond
+
+// sendSchedule decides how long a connection waits between messages.
+type sendSchedule interface {
+	// next returns the delay until the next message, random ones drawn
+	// from r.
+	next(r *rand.Rand) time.Duration
+}
+
+// fixedSchedule sends messages evenly spaced by the given interval.
+type fixedSchedule time.Duration
+
+func (s fixedSchedule) next(*rand.Rand) time.Duration {
+	return time.Duration(s)
+}
+
+// thinkTime sends messages after a random delay following a distribution.
+type thinkTime struct {
+	dist string
+	a, b time.Duration
+}
+
+func (t *thinkTime) next(r *rand.Rand) time.Duration {
+	var d time.Duration
+	switch t.dist {
+	case "exp":
+		d = time.Duration(r.ExpFloat64() * float64(t.a))
+	case "uniform":
+		d = t.a + time.Duration(r.Int63n(int64(t.b-t.a)+1))
+	case "normal":
+		d = t.a + time.Duration(r.NormFloat64()*float64(t.b))
+	}
+
+	if d < minSendDelay {
+		d = minSendDelay
+	}
+	return d
+}
+
+// parseSendSchedule parses a send schedule definition, one of:
+//
+//	interval:<duration>                  fixed interval between messages
+//	rate:<messages per second>           fixed rate per connection
+//	think:exp:<mean>                     exponentially distributed think time
+//	think:uniform:<min>:<max>            uniformly distributed think time
+//	think:normal:<mean>:<stddev>         normally distributed think time
+//
+// Fixed schedules may not send faster than every minSendDelay, random ones
+// never draw shorter delays.
+func parseSendSchedule(s string) (sendSchedule, error) {
+	parts := strings.Split(s, ":")
+	switch {
+	case parts[0] == "interval" && len(parts) == 2:
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < minSendDelay {
+			return nil, fmt.Errorf("invalid send schedule %q: bad interval, must be at least %v", s, minSendDelay)
+		}
+		return fixedSchedule(d), nil
+	case parts[0] == "rate" && len(parts) == 2:
+		r, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid send schedule %q: bad rate", s)
+		}
+		d := time.Duration(float64(time.Second) / r)
+		if d < minSendDelay {
+			return nil, fmt.Errorf("invalid send schedule %q: bad rate, must be at most %d per second", s, time.Second/minSendDelay)
+		}
+		return fixedSchedule(d), nil
+	case parts[0] == "think" && len(parts) >= 3:
+		return parseThinkTime(s, parts[1], parts[2:])
+	}
+
+	return nil, fmt.Errorf("invalid send schedule %q", s)
+}
+
+func parseThinkTime(s, dist string, args []string) (sendSchedule, error) {
+	var durations []time.Duration
+	for _, arg := range args {
+		d, err := time.ParseDuration(arg)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid send schedule %q: bad duration %q", s, arg)
+		}
+		durations = append(durations, d)
+	}
+
+	// a zero mean or maximum would only ever draw the minimum delay
+	switch {
+	case dist == "exp" && len(durations) == 1 && durations[0] > 0:
+		return &thinkTime{dist: dist, a: durations[0]}, nil
+	case dist == "uniform" && len(durations) == 2 && durations[0] <= durations[1] && durations[1] > 0:
+		return &thinkTime{dist: dist, a: durations[0], b: durations[1]}, nil
+	case dist == "normal" && len(durations) == 2 && durations[0] > 0:
+		return &thinkTime{dist: dist, a: durations[0], b: durations[1]}, nil
+	}
+
+	return nil, fmt.Errorf("invalid send schedule %q: bad think time distribution", s)
+}
+
+// workload describes the messages sent by every connection. Its schedule
+// can be changed and sending paused while the connections are running.
+type workload struct {
+	sync.RWMutex
+
+	schedule sendSchedule
+	raw      string
+	paused   bool
+	payload  *compiledTemplate
+
+	// Closed and replaced every time the schedule changes.
+	changed chan struct{}
+}
+
+// newWorkload creates a workload sending payload, rendered as a template with
+// the connection template data, following the given schedule. Static payloads
+// larger than maxSize, stamps included, are rejected.
+func newWorkload(schedule, payload string, maxSize int, stamped bool) (*workload, error) {
+	s, err := parseSendSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := compileTemplate(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+
+	if t.static() {
+		size := len(t.text)
+		if stamped {
+			size += maxStampSize
+		}
+		if size > maxSize && stamped {
+			return nil, fmt.Errorf("invalid payload: %d bytes, latency stamp included, exceed the read limit of %d", size, maxSize)
+		} else if size > maxSize {
+			return nil, fmt.Errorf("invalid payload: %d bytes exceed the read limit of %d", size, maxSize)
+		}
+	}
+
+	return &workload{schedule: s, raw: schedule, payload: t, changed: make(chan struct{})}, nil
+}
+
+// parsePayloadType returns the message type of the text or binary payload
+// type.
+func parsePayloadType(s string) (int, error) {
+	switch s {
+	case "text":
+		return websocket.TextMessage, nil
+	case "binary":
+		return websocket.BinaryMessage, nil
+	}
+	return 0, fmt.Errorf("invalid payload type %q: expected text or binary", s)
+}
+
+// first returns the delay until the first message. Fixed schedules start at a
+// random offset so connections created together do not send in lockstep.
+func (w *workload) first(r *rand.Rand) time.Duration {
+	w.RLock()
+	defer w.RUnlock()
+
+	if d, ok := w.schedule.(fixedSchedule); ok {
+		return time.Duration(r.Int63n(int64(d) + 1))
+	}
+	return w.schedule.next(r)
+}
+
+// next returns the delay until the next message.
+func (w *workload) next(r *rand.Rand) time.Duration {
+	w.RLock()
+	defer w.RUnlock()
+	return w.schedule.next(r)
+}
+
+// setSchedule replaces the send schedule, connections reschedule their next
+// message right away.
+func (w *workload) setSchedule(schedule string) error {
+	s, err := parseSendSchedule(schedule)
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.schedule, w.raw = s, schedule
+	close(w.changed)
+	w.changed = make(chan struct{})
+	return nil
+}
+
+// changes returns a channel closed the next time the schedule changes.
+func (w *workload) changes() <-chan struct{} {
+	w.RLock()
+	defer w.RUnlock()
+	return w.changed
+}
+
+// setPaused pauses or resumes sending.
+func (w *workload) setPaused(paused bool) {
+	w.Lock()
+	defer w.Unlock()
+	w.paused = paused
+}
+
+// state returns the current send schedule and whether sending is paused.
+func (w *workload) state() (string, bool) {
+	w.RLock()
+	defer w.RUnlock()
+	return w.raw, w.paused
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	// Replies a connection to a reply route may have held back at once.
+	maxPendingReplies = 1024
+)
+
+var (
+	errRepliesFull = errors.New("too many replies held back")
+)
+
+// behaviour is what the listener does with the connections of a route:
+//
+//	discard    read messages and drop them
+//	echo       send every message back as soon as it is read
+//	push       send size byte text messages at rate per second, ignoring reads
+//	reply      send every message back once delay has elapsed, closing
+//	           connections with too many replies held back
+//	broadcast  send every message to all the connections in the same room
+type behaviour struct {
+	mode string
+
+	// Messages per second and payload of push routes.
+	rate    float64
+	payload []byte
+
+	// Time replies are held back on reply routes.
+	delay time.Duration
+
+	// Rooms of broadcast routes, named after the query parameter roomParam
+	// or the request path if empty.
+	hub       *hub
+	roomParam string
+}
+
+// route binds a behaviour to a request path pattern, as understood by
+// http.ServeMux.
+type route struct {
+	pattern   string
+	behaviour *behaviour
+}
+
+// parseRoute parses a route as pattern=mode[,key=value...], where push
+// accepts rate (default 1) and size (default 64, up to maxSize), reply
+// accepts delay (default 0s) and broadcast accepts room (the query parameter
+// naming rooms).
+func parseRoute(s string, maxSize int) (*route, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid route %q: expected pattern=mode[,key=value...]", s)
+	}
+	pattern, spec := s[:i], s[i+1:]
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("invalid route %q: pattern must start with /", s)
+	}
+
+	fields := strings.Split(spec, ",")
+	b := &behaviour{mode: fields[0], rate: 1}
+	size := 64
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid route %q: expected key=value, got %q", s, f)
+		}
+
+		var err error
+		switch k, v := kv[0], kv[1]; {
+		case k == "rate" && b.mode == "push":
+			b.rate, err = strconv.ParseFloat(v, 64)
+			if err == nil && b.rate <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case k == "size" && b.mode == "push":
+			size, err = strconv.Atoi(v)
+			if err == nil && size < 0 {
+				err = fmt.Errorf("must not be negative")
+			} else if err == nil && size > maxSize {
+				err = fmt.Errorf("%d bytes exceed the read limit of %d", size, maxSize)
+			}
+		case k == "delay" && b.mode == "reply":
+			b.delay, err = time.ParseDuration(v)
+			if err == nil && b.delay < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case k == "room" && b.mode == "broadcast":
+			b.roomParam = v
+			if v == "" {
+				err = fmt.Errorf("must not be empty")
+			}
+		default:
+			return nil, fmt.Errorf("invalid route %q: unknown %s option %q", s, b.mode, k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %s: %v", s, kv[0], err)
+		}
+	}
+
+	switch b.mode {
+	case "discard", "echo", "reply":
+	case "broadcast":
+		b.hub = newHub()
+	case "push":
+		b.payload = make([]byte, size)
+		for i := range b.payload {
+			b.payload[i] = letters[rand.Intn(len(letters))]
+		}
+	default:
+		return nil, fmt.Errorf("invalid route %q: unknown mode %q: expected discard, echo, push, reply or broadcast", s, b.mode)
+	}
+
+	return &route{pattern, b}, nil
+}
+
+// pushing returns a ticker firing every time a push route sends a message,
+// nil for other routes.
+func (b *behaviour) pushing() *time.Ticker {
+	if b.mode != "push" {
+		return nil
+	}
+	return time.NewTicker(time.Duration(float64(time.Second) / b.rate))
+}
+
+// push sends the next pushed message.
+func (b *behaviour) push(c *util.WebSocketClient) error {
+	return c.SendMessage(&util.Message{
+		Type: websocket.TextMessage,
+		Data: b.payload,
+	})
+}
+
+// room returns the room of a request to a broadcast route, connections
+// lacking the room query parameter share the unnamed room.
+func (b *behaviour) room(r *http.Request) string {
+	if b.roomParam != "" {
+		return r.URL.Query().Get(b.roomParam)
+	}
+	return r.URL.Path
+}
+
+// replying returns the queue holding back the replies of a connection to a
+// reply route, nil for other routes.
+func (b *behaviour) replying() *replies {
+	if b.mode != "reply" {
+		return nil
+	}
+	return &replies{delay: b.delay}
+}
+
+// received handles a message read from a connection in a room, replies are
+// queued in q.
+func (b *behaviour) received(c *util.WebSocketClient, room string, q *replies, m *util.Message) error {
+	switch b.mode {
+	case "broadcast":
+		b.hub.publish(room, m)
+	case "echo":
+		return c.SendMessage(m)
+	case "reply":
+		return q.add(m)
+	}
+	return nil
+}
+
+// reply is a message to be sent back once due.
+type reply struct {
+	due     time.Time
+	message *util.Message
+}
+
+// replies holds back the replies of a connection, sending them once their
+// delay has elapsed. As the delay is the same for all of them they are due
+// in order, so a single timer set for the oldest one is enough. It is not
+// safe for concurrent use.
+type replies struct {
+	delay   time.Duration
+	pending []reply
+	timer   *time.Timer
+}
+
+// C returns a channel firing when the oldest reply is due, nil if none is
+// pending.
+func (q *replies) C() <-chan time.Time {
+	if q.timer == nil {
+		return nil
+	}
+	return q.timer.C
+}
+
+// add queues a reply, failing with errRepliesFull if maxPendingReplies are
+// already pending.
+func (q *replies) add(m *util.Message) error {
+	if len(q.pending) >= maxPendingReplies {
+		return errRepliesFull
+	}
+
+	q.pending = append(q.pending, reply{time.Now().Add(q.delay), m})
+	if q.timer == nil {
+		q.timer = time.NewTimer(q.delay)
+	}
+	return nil
+}
+
+// flush sends the replies that are due once C fires and sets the timer for
+// the next one.
+func (q *replies) flush(c *util.WebSocketClient) error {
+	q.timer = nil
+
+	now := time.Now()
+	for len(q.pending) > 0 && !q.pending[0].due.After(now) {
+		m := q.pending[0].message
+		q.pending = q.pending[1:]
+		if err := c.SendMessage(m); err != nil {
+			return err
+		}
+	}
+
+	if len(q.pending) > 0 {
+		q.timer = time.NewTimer(q.pending[0].due.Sub(now))
+	}
+	return nil
+}
+
+// stop drops the pending replies.
+func (q *replies) stop() {
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.timer, q.pending = nil, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+
+	"github.com/glerchundi/loadtesting-ws/util"
+)
+
+// subscription is a connection joining or leaving a room.
+type subscription struct {
+	room   string
+	client *util.WebSocketClient
+}
+
+// publication is a message published to a room.
+type publication struct {
+	room    string
+	message *util.Message
+}
+
+// hub maintains the rooms of a broadcast route and fans the messages
+// published to a room out to all of its connections.
+type hub struct {
+	// Connections of every room, rooms are removed once empty.
+	rooms map[string]map[*util.WebSocketClient]bool
+
+	// Inbound messages from the connections.
+	broadcast chan *publication
+
+	// Register requests from the connections.
+	register chan *subscription
+
+	// Unregister requests from connections.
+	unregister chan *subscription
+}
+
+// newHub creates a new hub, run must be called for it to serve requests.
+func newHub() *hub {
+	return &hub{
+		rooms:      make(map[string]map[*util.WebSocketClient]bool),
+		broadcast:  make(chan *publication),
+		register:   make(chan *subscription),
+		unregister: make(chan *subscription),
+	}
+}
+
+// join adds a connection to a room.
+func (h *hub) join(room string, c *util.WebSocketClient) {
+	h.register <- &subscription{room, c}
+}
+
+// leave removes a connection from a room.
+func (h *hub) leave(room string, c *util.WebSocketClient) {
+	h.unregister <- &subscription{room, c}
+}
+
+// publish sends a message to every connection in a room, the publisher
+// included.
+func (h *hub) publish(room string, m *util.Message) {
+	h.broadcast <- &publication{room, m}
+}
+
+func (h *hub) run() {
+	for {
+		select {
+		case s := <-h.register:
+			members, ok := h.rooms[s.room]
+			if !ok {
+				members = make(map[*util.WebSocketClient]bool)
+				h.rooms[s.room] = members
+				wsRoomsActive.Inc()
+			}
+			members[s.client] = true
+		case s := <-h.unregister:
+			h.remove(s.room, s.client)
+		case p := <-h.broadcast:
+			for c := range h.rooms[p.room] {
+				// connections not keeping up are closed instead of
+				// stalling the whole room
+				if err := c.TrySendMessage(p.message); err != nil {
+					if err == util.ErrFull {
+						wsConnectionsEvicted.Inc()
+						log.Printf("Evicting client from room %q: %v\n", p.room, err)
+					}
+					h.remove(p.room, c)
+					c.Close()
+				}
+			}
+		}
+	}
+}
+
+// remove drops a connection from a room, if still there.
+func (h *hub) remove(room string, c *util.WebSocketClient) {
+	members := h.rooms[room]
+	if _, ok := members[c]; !ok {
+		return
+	}
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		wsRoomsActive.Dec()
+	}
+}
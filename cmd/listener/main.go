@@ -26,43 +26,59 @@ var (
 )
 
 var (
-	upgrader  websocket.Upgrader
-	waitGroup *util.WaitGroup
-	quitting  chan struct{}
-
-	wsConnectionsActive = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "ws_connections_active",
-			Help: "Total number of connections.",
-		},
-	)
+	upgrader     websocket.Upgrader
+	subprotocols *subprotocolPolicy
+	waitGroup    *util.WaitGroup
+	quitting     chan struct{}
 
-	wsConnectionsFailed = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "ws_connections_failed",
-			Help: "Failed number of connections.",
-		},
-	)
+	// Maximum size of the messages read by connections.
+	readLimit int64 = util.DefaultReadLimit
 )
 
 type httpError struct {
 	code int
+	err  error
 }
 
 func (he *httpError) Error() string {
+	if he.err != nil {
+		return fmt.Sprintf("http error: %d: %v", he.code, he.err)
+	}
 	return fmt.Sprintf("http error: %d", he.code)
 }
 
-func init() {
-	prometheus.MustRegister(wsConnectionsActive)
-	prometheus.MustRegister(wsConnectionsFailed)
+// errorClass returns a short label describing why a connection failed: the
+// upgrade was refused (bad_handshake), the subprotocol policy refused it
+// (subprotocol) or the established connection failed (see util.ConnError).
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case *httpError:
+		if _, ok := e.err.(*subprotocolError); ok {
+			return "subprotocol"
+		}
+		return "bad_handshake"
+	case *util.ConnError:
+		return e.Class()
+	}
+	return "other"
 }
 
 func main() {
 	var port int = 8080
+	var supportedSubprotocols []string
+	var subprotocolPreference string = "server"
+	var rejectedSubprotocols []string
+	var requireSubprotocol bool = false
+	var routesRaw []string
 
 	fs := pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
 	fs.IntVar(&port, "port", port, "")
+	fs.StringArrayVar(&supportedSubprotocols, "subprotocol", supportedSubprotocols, "supported subprotocol, in order of preference, can be repeated")
+	fs.StringVar(&subprotocolPreference, "subprotocol-preference", subprotocolPreference, "whose order of preference selects among the supported subprotocols requested: server or client")
+	fs.StringArrayVar(&rejectedSubprotocols, "reject-subprotocol", rejectedSubprotocols, "refuse handshakes requesting this subprotocol, can be repeated")
+	fs.BoolVar(&requireSubprotocol, "require-subprotocol", requireSubprotocol, "refuse handshakes not requesting a supported subprotocol")
+	fs.Int64Var(&readLimit, "read-limit", readLimit, "maximum size of received messages, connections receiving larger ones fail, and of pushed ones, as clients are expected to read as much")
+	fs.StringArrayVar(&routesRaw, "route", routesRaw, "behaviour of the connections to a path pattern as pattern=mode[,key=value...]: discard, echo, push[,rate=<per second>][,size=<bytes>], reply[,delay=<duration>] or broadcast[,room=<query parameter>] to rooms named after the parameter or the path (e.g. /feed=push,rate=10,size=256, /rooms/=broadcast), unmatched paths discard, can be repeated")
 
 	// set normalization func
 	fs.SetNormalizeFunc(
@@ -85,7 +101,39 @@ func main() {
 	// parse
 	fs.Parse(os.Args[1:])
 
+	if subprotocolPreference != "server" && subprotocolPreference != "client" {
+		log.Fatalf("invalid subprotocol preference %q: expected server or client\n", subprotocolPreference)
+	}
+
+	if readLimit < 1 {
+		log.Fatalf("invalid read-limit %d: must be positive\n", readLimit)
+	}
+
+	routes := map[string]*route{
+		"/": {"/", &behaviour{mode: "discard"}},
+	}
+	for _, raw := range routesRaw {
+		r, err := parseRoute(raw, int(readLimit))
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if r.pattern == "/metrics" || r.pattern == "/favicon.ico" {
+			log.Fatalf("invalid route %q: %s is reserved\n", raw, r.pattern)
+		}
+		routes[r.pattern] = r
+	}
+
 	upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	subprotocols = &subprotocolPolicy{
+		supported:    supportedSubprotocols,
+		preferClient: subprotocolPreference == "client",
+		rejected:     make(map[string]bool),
+		required:     requireSubprotocol,
+	}
+	for _, s := range rejectedSubprotocols {
+		subprotocols.rejected[s] = true
+	}
+
 	waitGroup = util.NewWaitGroup()
 	quitting = make(chan struct{})
 
@@ -98,20 +146,12 @@ func main() {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte{})
 	})
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-
-		if err := websocketHandler(w, r); err != nil {
-			wsConnectionsFailed.Inc()
-
-			log.Printf("%v\n", err)
-
-			if he, ok := err.(*httpError); ok {
-				w.WriteHeader(he.code)
-				w.Write([]byte{})
-			}
-
+	for _, rt := range routes {
+		if rt.behaviour.hub != nil {
+			go rt.behaviour.hub.run()
 		}
-	})
+		mux.HandleFunc(rt.pattern, routeHandler(rt))
+	}
 
 	server := &graceful.Server{
 		Timeout: 10 * time.Second,
@@ -133,32 +173,114 @@ func main() {
 	}
 }
 
-func websocketHandler(w http.ResponseWriter, r *http.Request) error {
+// routeHandler serves the websocket connections of a route.
+func routeHandler(rt *route) http.HandlerFunc {
+	metrics := newRouteMetrics(rt.pattern)
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if err := websocketHandler(w, r, rt.behaviour, metrics); err != nil {
+			wsConnectionsFailed.WithLabelValues(errorClass(err)).Inc()
+
+			log.Printf("%v\n", err)
+
+			if he, ok := err.(*httpError); ok {
+				w.WriteHeader(he.code)
+				w.Write([]byte{})
+			}
+
+		}
+	}
+}
+
+func websocketHandler(w http.ResponseWriter, r *http.Request, b *behaviour, metrics *routeMetrics) error {
 	waitGroup.Add(1)
 	defer waitGroup.Done()
 
 	wsConnectionsActive.Inc()
 	defer wsConnectionsActive.Dec()
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	subprotocol, err := subprotocols.negotiate(websocket.Subprotocols(r))
+	if err != nil {
+		return err
+	}
+
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		return &httpError{http.StatusForbidden}
+		return &httpError{http.StatusForbidden, err}
 	}
 
 	wsclient := util.NewWebSocketClient(conn)
+	wsclient.SetReadLimit(readLimit)
+	wsclient.Observe(metrics)
 	wsclient.Run()
 	defer wsclient.Close()
 
+	start := time.Now()
+	defer func() {
+		metrics.duration.Observe(time.Since(start).Seconds())
+	}()
+
 	log.Printf("Client connected to: %s\n", r.URL)
 	defer log.Printf("Client disconnected from: %s\n", r.URL)
 
+	room := b.room(r)
+	if b.hub != nil {
+		b.hub.join(room, wsclient)
+		defer b.hub.leave(room, wsclient)
+	}
+
+	var pushing <-chan time.Time
+	if ticker := b.pushing(); ticker != nil {
+		defer ticker.Stop()
+		pushing = ticker.C
+	}
+
+	replies := b.replying()
+	if replies != nil {
+		defer replies.stop()
+	}
+
 	for {
+		var replying <-chan time.Time
+		if replies != nil {
+			replying = replies.C()
+		}
+
 		select {
 		case <-quitting:
 			return nil
-		case _, ok := <-wsclient.ReadMessage():
+		case m, ok := <-wsclient.ReadMessage():
 			if !ok {
-				return nil
+				// connections closed by the listener itself (e.g. evicted
+				// from a room) received no close frame and failed no read
+				code, err := wsclient.CloseCode(), wsclient.Err()
+				if code != 0 || err != nil {
+					metrics.closed(code)
+				}
+				return err
+			}
+			err := b.received(wsclient, room, replies, m)
+			if err == errRepliesFull {
+				// clients sending faster than replies are let out are
+				// closed instead of holding back replies without bound
+				wsConnectionsEvicted.Inc()
+				log.Printf("Evicting client from %s: %v\n", r.URL, err)
+				wsclient.Close()
+			} else if err != nil {
+				log.Printf("Sending to client at %s failed: %v\n", r.URL, err)
+			}
+		case <-replying:
+			if err := replies.flush(wsclient); err != nil {
+				log.Printf("Sending to client at %s failed: %v\n", r.URL, err)
+			}
+		case <-pushing:
+			if err := b.push(wsclient); err != nil {
+				log.Printf("Sending to client at %s failed: %v\n", r.URL, err)
 			}
 		}
 	}
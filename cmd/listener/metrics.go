@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Buckets for connection durations between 100ms and ~3.6h.
+	connectionDurationBuckets = prometheus.ExponentialBuckets(0.1, 2, 18)
+
+	// Frame type labels, see frameKind.
+	frameKinds = []string{"text", "binary", "control"}
+
+	wsConnectionsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ws_connections_active",
+			Help: "Total number of connections.",
+		},
+	)
+
+	wsConnectionsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_connections_failed",
+			Help: "Failed number of connections by error class.",
+		},
+		[]string{"class"},
+	)
+
+	wsRoomsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ws_rooms_active",
+			Help: "Number of broadcast rooms with connections.",
+		},
+	)
+
+	wsConnectionsEvicted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ws_connections_evicted",
+			Help: "Number of connections closed for not keeping up with broadcasts or sending faster than delayed replies are let out.",
+		},
+	)
+
+	wsMessagesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_messages_received",
+			Help: "Number of messages and control frames received by route and frame type.",
+		},
+		[]string{"route", "type"},
+	)
+
+	wsBytesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_bytes_received",
+			Help: "Payload bytes received by route and frame type.",
+		},
+		[]string{"route", "type"},
+	)
+
+	wsMessagesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_messages_sent",
+			Help: "Number of messages and control frames sent by route and frame type.",
+		},
+		[]string{"route", "type"},
+	)
+
+	wsBytesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_bytes_sent",
+			Help: "Payload bytes sent by route and frame type.",
+		},
+		[]string{"route", "type"},
+	)
+
+	wsConnectionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ws_connection_duration_seconds",
+			Help:    "Time connections stayed open by route.",
+			Buckets: connectionDurationBuckets,
+		},
+		[]string{"route"},
+	)
+
+	wsConnectionsClosed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_connections_closed",
+			Help: "Number of connections closed by the clients by route and close code, 1006 if no close frame was received.",
+		},
+		[]string{"route", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(wsConnectionsActive)
+	prometheus.MustRegister(wsConnectionsFailed)
+	prometheus.MustRegister(wsRoomsActive)
+	prometheus.MustRegister(wsConnectionsEvicted)
+	prometheus.MustRegister(wsMessagesReceived)
+	prometheus.MustRegister(wsBytesReceived)
+	prometheus.MustRegister(wsMessagesSent)
+	prometheus.MustRegister(wsBytesSent)
+	prometheus.MustRegister(wsConnectionDuration)
+	prometheus.MustRegister(wsConnectionsClosed)
+}
+
+// frameKind returns the index in frameKinds of a message type.
+func frameKind(mt int) int {
+	switch mt {
+	case websocket.TextMessage:
+		return 0
+	case websocket.BinaryMessage:
+		return 1
+	}
+	return 2
+}
+
+// routeMetrics are the metrics of the connections to a route, labelled with
+// the route pattern rather than the request path so that the number of
+// series stays bounded. Counters are resolved upfront, indexed by frameKind,
+// so observing a frame costs no label lookups.
+type routeMetrics struct {
+	route string
+
+	messagesReceived [3]prometheus.Counter
+	bytesReceived    [3]prometheus.Counter
+	messagesSent     [3]prometheus.Counter
+	bytesSent        [3]prometheus.Counter
+
+	duration prometheus.Histogram
+}
+
+// newRouteMetrics resolves the metrics of a route.
+func newRouteMetrics(route string) *routeMetrics {
+	m := &routeMetrics{
+		route:    route,
+		duration: wsConnectionDuration.WithLabelValues(route),
+	}
+	for i, kind := range frameKinds {
+		m.messagesReceived[i] = wsMessagesReceived.WithLabelValues(route, kind)
+		m.bytesReceived[i] = wsBytesReceived.WithLabelValues(route, kind)
+		m.messagesSent[i] = wsMessagesSent.WithLabelValues(route, kind)
+		m.bytesSent[i] = wsBytesSent.WithLabelValues(route, kind)
+	}
+	return m
+}
+
+// Read implements util.Observer.
+func (m *routeMetrics) Read(mt int, n int) {
+	k := frameKind(mt)
+	m.messagesReceived[k].Inc()
+	m.bytesReceived[k].Add(float64(n))
+}
+
+// Written implements util.Observer.
+func (m *routeMetrics) Written(mt int, n int) {
+	k := frameKind(mt)
+	m.messagesSent[k].Inc()
+	m.bytesSent[k].Add(float64(n))
+}
+
+// closed accounts a connection closed by the client with the given close
+// code, 0 if it sent no close frame.
+func (m *routeMetrics) closed(code int) {
+	if code == 0 {
+		code = websocket.CloseAbnormalClosure
+	}
+	wsConnectionsClosed.WithLabelValues(m.route, strconv.Itoa(code)).Inc()
+}
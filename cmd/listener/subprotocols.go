@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// subprotocolError is a handshake refused by the subprotocol policy.
+type subprotocolError struct {
+	reason string
+}
+
+func (e *subprotocolError) Error() string {
+	return e.reason
+}
+
+// subprotocolPolicy negotiates the subprotocol of incoming handshakes.
+type subprotocolPolicy struct {
+	// Supported subprotocols in order of server preference.
+	supported []string
+
+	// Select the first supported subprotocol in the client's order instead.
+	preferClient bool
+
+	// Refuse handshakes requesting any of these subprotocols.
+	rejected map[string]bool
+
+	// Refuse handshakes not requesting a supported subprotocol.
+	required bool
+}
+
+// negotiate selects the subprotocol for the requested ones, empty selects
+// none.
+func (p *subprotocolPolicy) negotiate(requested []string) (string, error) {
+	for _, s := range requested {
+		if p.rejected[s] {
+			return "", &httpError{http.StatusBadRequest, &subprotocolError{fmt.Sprintf("subprotocol %q rejected", s)}}
+		}
+	}
+
+	preferred, other := p.supported, requested
+	if p.preferClient {
+		preferred, other = requested, p.supported
+	}
+	for _, s := range preferred {
+		for _, o := range other {
+			if s == o {
+				return s, nil
+			}
+		}
+	}
+
+	if p.required {
+		return "", &httpError{http.StatusBadRequest, &subprotocolError{fmt.Sprintf("no supported subprotocol requested in %q", requested)}}
+	}
+	return "", nil
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Values below this are recorded exactly, above it every power of two is
+	// split in histogramSubBuckets buckets (~1.5% relative error).
+	histogramLinear     = 128
+	histogramSubBuckets = histogramLinear / 2
+	histogramBuckets    = histogramLinear + 57*histogramSubBuckets
+)
+
+// Histogram is a log-linear histogram of durations, recorded with microsecond
+// resolution. It is safe for concurrent use.
+type Histogram struct {
+	sync.Mutex
+
+	counts []int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram creates an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]int64, histogramBuckets),
+	}
+}
+
+// bucketOf returns the bucket index of a value in microseconds.
+func bucketOf(v int64) int {
+	if v < histogramLinear {
+		return int(v)
+	}
+
+	shift := uint(0)
+	for (v >> shift) >= histogramLinear {
+		shift++
+	}
+	return histogramLinear + int(shift-1)*histogramSubBuckets + int(v>>shift) - histogramSubBuckets
+}
+
+// valueOf returns the value in microseconds representing a bucket.
+func valueOf(bucket int) int64 {
+	if bucket < histogramLinear {
+		return int64(bucket)
+	}
+
+	shift := uint((bucket-histogramLinear)/histogramSubBuckets + 1)
+	m := int64((bucket-histogramLinear)%histogramSubBuckets + histogramSubBuckets)
+	return m<<shift + (int64(1)<<shift)/2
+}
+
+// Record adds a duration to the histogram
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.counts[bucketOf(int64(d/time.Microsecond))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Count returns the number of recorded durations
+func (h *Histogram) Count() int64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.count
+}
+
+// Quantile returns the duration below which the given fraction (0-1) of the
+// recorded durations fall
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return h.quantile(q)
+}
+
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	if q >= 1 {
+		return h.max
+	}
+
+	// nearest rank: the smallest value with at least q of the count at or
+	// below it
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for bucket, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			d := time.Duration(valueOf(bucket)) * time.Microsecond
+			if d > h.max {
+				d = h.max
+			}
+			if d < h.min {
+				d = h.min
+			}
+			return d
+		}
+	}
+
+	return h.max
+}
+
+// HistogramSnapshot summarizes the recorded durations.
+type HistogramSnapshot struct {
+	Count int64         `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	P999  time.Duration `json:"p99_9"`
+	Max   time.Duration `json:"max"`
+}
+
+// Snapshot returns a summary of the recorded durations
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.Lock()
+	defer h.Unlock()
+
+	s := HistogramSnapshot{
+		Count: h.count,
+		Min:   h.min,
+		P50:   h.quantile(0.5),
+		P90:   h.quantile(0.9),
+		P99:   h.quantile(0.99),
+		P999:  h.quantile(0.999),
+		Max:   h.max,
+	}
+	if h.count > 0 {
+		s.Mean = h.sum / time.Duration(h.count)
+	}
+
+	return s
+}
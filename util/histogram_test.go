@@ -0,0 +1,112 @@
+package util
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBucketBoundaries(t *testing.T) {
+	tests := []struct {
+		v      int64
+		bucket int
+	}{
+		{0, 0},
+		{1, 1},
+		{histogramLinear - 1, histogramLinear - 1},
+		{histogramLinear, histogramLinear},
+		{histogramLinear + 1, histogramLinear},
+		{histogramLinear + 2, histogramLinear + 1},
+		{2*histogramLinear - 1, histogramLinear + histogramSubBuckets - 1},
+		{2 * histogramLinear, histogramLinear + histogramSubBuckets},
+		{4*histogramLinear - 1, histogramLinear + 2*histogramSubBuckets - 1},
+		{4 * histogramLinear, histogramLinear + 2*histogramSubBuckets},
+	}
+	for _, tt := range tests {
+		if got := bucketOf(tt.v); got != tt.bucket {
+			t.Errorf("bucketOf(%d) = %d, want %d", tt.v, got, tt.bucket)
+		}
+	}
+
+	if got := bucketOf(math.MaxInt64); got >= histogramBuckets {
+		t.Errorf("bucketOf(MaxInt64) = %d, want below %d", got, histogramBuckets)
+	}
+}
+
+func TestBucketValues(t *testing.T) {
+	for v := int64(0); v < histogramLinear; v++ {
+		if got := valueOf(bucketOf(v)); got != v {
+			t.Errorf("valueOf(bucketOf(%d)) = %d, want exact", v, got)
+		}
+	}
+
+	last := -1
+	for v := int64(histogramLinear); v < 1<<40; v += v/7 + 1 {
+		bucket := bucketOf(v)
+		if bucket < last {
+			t.Fatalf("bucketOf(%d) = %d, below the bucket of a smaller value %d", v, bucket, last)
+		}
+		last = bucket
+
+		got := valueOf(bucket)
+		if err := math.Abs(float64(got-v)) / float64(v); err > 1.0/histogramSubBuckets {
+			t.Errorf("valueOf(bucketOf(%d)) = %d, relative error %.4f", v, got, err)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	ms := func(n int) []time.Duration {
+		var ds []time.Duration
+		for i := 1; i <= n; i++ {
+			ds = append(ds, time.Duration(i)*time.Millisecond)
+		}
+		return ds
+	}
+
+	tests := []struct {
+		name   string
+		values []time.Duration
+		q      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single", []time.Duration{7 * time.Millisecond}, 0.5, 7 * time.Millisecond},
+		{"two p50", []time.Duration{time.Millisecond, 100 * time.Millisecond}, 0.5, time.Millisecond},
+		{"two p51", []time.Duration{time.Millisecond, 100 * time.Millisecond}, 0.51, 100 * time.Millisecond},
+		{"min", ms(100), 0, time.Millisecond},
+		{"p1", ms(100), 0.01, time.Millisecond},
+		{"p50", ms(100), 0.5, 50 * time.Millisecond},
+		{"p90", ms(100), 0.9, 90 * time.Millisecond},
+		{"p99", ms(100), 0.99, 99 * time.Millisecond},
+		{"max", ms(100), 1, 100 * time.Millisecond},
+		{"exact", []time.Duration{10 * time.Microsecond, 20 * time.Microsecond, 30 * time.Microsecond}, 0.5, 20 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		h := NewHistogram()
+		for _, v := range tt.values {
+			h.Record(v)
+		}
+
+		got := h.Quantile(tt.q)
+		if err := math.Abs(float64(got-tt.want)) / float64(tt.want); tt.want == 0 && got != 0 || err > 1.0/histogramSubBuckets {
+			t.Errorf("%s: Quantile(%v) = %v, want %v", tt.name, tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	h := NewHistogram()
+	if s := h.Snapshot(); s != (HistogramSnapshot{}) {
+		t.Errorf("empty snapshot = %+v, want zero", s)
+	}
+
+	h.Record(-time.Millisecond)
+	h.Record(2 * time.Millisecond)
+	h.Record(4 * time.Millisecond)
+
+	s := h.Snapshot()
+	if s.Count != 3 || s.Min != 0 || s.Max != 4*time.Millisecond || s.Mean != 2*time.Millisecond {
+		t.Errorf("snapshot = %+v, want count 3, min 0, max 4ms and mean 2ms", s)
+	}
+}
@@ -1,7 +1,11 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,11 +20,55 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+)
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+const (
+	// DefaultReadLimit is the maximum message size allowed from peer unless
+	// changed with SetReadLimit.
+	DefaultReadLimit = 64 * 1024
 )
 
+var (
+	// ErrClosed is returned when sending through a client whose writer stopped.
+	ErrClosed = errors.New("websocket client closed")
+
+	// ErrFull is returned when trying to send through a client whose writing
+	// channel is full.
+	ErrFull = errors.New("websocket client send buffer full")
+)
+
+// ConnError is a failure reading from or writing to an established
+// connection.
+type ConnError struct {
+	Op  string
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Class returns a short label describing the failure: the operation,
+// suffixed with _timeout for timeouts, or close_<code> for connections
+// closed by the peer with an abnormal close code.
+func (e *ConnError) Class() string {
+	if ce, ok := e.Err.(*websocket.CloseError); ok {
+		return fmt.Sprintf("close_%d", ce.Code)
+	}
+	if ne, ok := e.Err.(net.Error); ok && ne.Timeout() {
+		return e.Op + "_timeout"
+	}
+	return e.Op
+}
+
+// Observer is notified of every message and control frame read from or
+// written to a connection, with its type and payload size. It is called from
+// the reader and writer routines concurrently.
+type Observer interface {
+	Read(mt int, n int)
+	Written(mt int, n int)
+}
+
 // Message is  a bare minimum representation of a websocket message.
 type Message struct {
 	Type int
@@ -37,14 +85,32 @@ type WebSocketClient struct {
 
 	// Buffered channel of outbound messages.
 	send chan *Message
+
+	// Closed when the writer stops.
+	done chan struct{}
+
+	// Notified of the frames read and written, nil observes nothing.
+	observer Observer
+
+	// Maximum message size allowed from peer.
+	readLimit int64
+
+	// First error stopping the reader or writer before the client was closed,
+	// and the close code received from the peer, 0 if none.
+	mu        sync.Mutex
+	closed    bool
+	err       error
+	closeCode int
 }
 
 // NewWebSocketClient creates a new websocket client
 func NewWebSocketClient(conn *websocket.Conn) *WebSocketClient {
 	return &WebSocketClient{
-		conn: conn,
-		recv: make(chan *Message, 256),
-		send: make(chan *Message, 256),
+		conn:      conn,
+		readLimit: DefaultReadLimit,
+		recv:      make(chan *Message, 256),
+		send:      make(chan *Message, 256),
+		done:      make(chan struct{}),
 	}
 }
 
@@ -55,18 +121,41 @@ func (c *WebSocketClient) readPump() {
 		close(c.recv)
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.readLimit)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(appData string) error {
+		c.read(websocket.PongMessage, len(appData))
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	c.conn.SetPingHandler(func(appData string) error {
+		c.read(websocket.PingMessage, len(appData))
+		err := c.conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeWait))
+		if err == nil {
+			c.written(websocket.PongMessage, len(appData))
+		} else if err == websocket.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
 	for {
 		t, d, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+			if ce, ok := err.(*websocket.CloseError); ok {
+				c.closedBy(ce)
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
 				log.Printf("%v\n", err)
 			}
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				c.fail("read", err)
+			}
 			break
 		}
 
+		c.read(t, len(d))
 		c.recv <- &Message{t, d}
 	}
 }
@@ -74,7 +163,11 @@ func (c *WebSocketClient) readPump() {
 // write writes a message with the given message type and payload.
 func (c *WebSocketClient) write(mt int, payload []byte) error {
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	return c.conn.WriteMessage(mt, payload)
+	if err := c.conn.WriteMessage(mt, payload); err != nil {
+		return err
+	}
+	c.written(mt, len(payload))
+	return nil
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -83,6 +176,7 @@ func (c *WebSocketClient) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.Close()
+		close(c.done)
 	}()
 
 	for {
@@ -97,15 +191,19 @@ func (c *WebSocketClient) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			w, err := c.conn.NextWriter(message.Type)
 			if err != nil {
+				c.fail("write", err)
 				return
 			}
 			w.Write(message.Data)
 
 			if err := w.Close(); err != nil {
+				c.fail("write", err)
 				return
 			}
+			c.written(message.Type, len(message.Data))
 		case <-ticker.C:
 			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
+				c.fail("write", err)
 				return
 			}
 		}
@@ -122,17 +220,113 @@ func (c *WebSocketClient) Run() {
 
 // Close closes underlying websocket connection
 func (c *WebSocketClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
 	return c.conn.Close()
 }
 
+// SetReadLimit sets the maximum message size allowed from peer, larger ones
+// fail the connection, it must be called before Run.
+func (c *WebSocketClient) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// Observe sets the observer notified of the frames read and written, it must
+// be called before Run.
+func (c *WebSocketClient) Observe(o Observer) {
+	c.observer = o
+}
+
+// read notifies the observer of a frame read.
+func (c *WebSocketClient) read(mt int, n int) {
+	if c.observer != nil {
+		c.observer.Read(mt, n)
+	}
+}
+
+// written notifies the observer of a frame written.
+func (c *WebSocketClient) written(mt int, n int) {
+	if c.observer != nil {
+		c.observer.Written(mt, n)
+	}
+}
+
+// closedBy records the close frame received from the peer, which the
+// connection echoes back with its code alone.
+func (c *WebSocketClient) closedBy(ce *websocket.CloseError) {
+	if ce.Code == websocket.CloseNoStatusReceived {
+		c.read(websocket.CloseMessage, 0)
+		c.written(websocket.CloseMessage, 0)
+	} else {
+		c.read(websocket.CloseMessage, 2+len(ce.Text))
+		c.written(websocket.CloseMessage, 2)
+	}
+
+	c.mu.Lock()
+	c.closeCode = ce.Code
+	c.mu.Unlock()
+}
+
+// fail records the error stopping the reader or writer, unless the client
+// was already closed.
+func (c *WebSocketClient) fail(op string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed && c.err == nil {
+		c.err = &ConnError{op, err}
+	}
+}
+
+// Err returns the *ConnError that stopped the client, nil if it was closed
+// cleanly.
+func (c *WebSocketClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// CloseCode returns the close code received from the peer, 0 if the
+// connection ended without a close frame (websocket.CloseNoStatusReceived if
+// the frame carried no code).
+func (c *WebSocketClient) CloseCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeCode
+}
+
 // ReadMessage returns a Message reading channel
 func (c *WebSocketClient) ReadMessage() <-chan *Message {
 	return c.recv
 }
 
-// SendMessage enqueues a Message in the writing channel
-func (c *WebSocketClient) SendMessage(m *Message) {
-	c.send <- m
+// SendMessage enqueues a Message in the writing channel, it fails with
+// ErrClosed once the writer has stopped
+func (c *WebSocketClient) SendMessage(m *Message) error {
+	select {
+	case c.send <- m:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// TrySendMessage enqueues a Message in the writing channel without blocking,
+// it fails with ErrFull if the channel is full and ErrClosed once the writer
+// has stopped
+func (c *WebSocketClient) TrySendMessage(m *Message) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.send <- m:
+		return nil
+	default:
+		return ErrFull
+	}
 }
 
 func (c *WebSocketClient) Conn() *websocket.Conn {